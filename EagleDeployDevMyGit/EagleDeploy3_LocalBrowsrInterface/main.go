@@ -1,9 +1,39 @@
 package main
 
 import (
+    "encoding/json"
     "fmt"
     "log"
+    "net"
     "net/http"
+    "net/url"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+
+    "EagleDeploy/engine"
+)
+
+// The most recent playbook run, reported by /task-status
+var (
+    lastResult   *engine.RunResult
+    lastResultMu sync.Mutex
+)
+
+// The output lines of the current or most recent run, reported by /logs.
+// Only one playbook runs at a time, so the lines never mix two runs
+var (
+    runLog   []engine.OutputLine
+    running  bool
+    runLogMu sync.Mutex
+)
+
+// The server only listens on the loopback interface, and only runs playbooks
+// that sit directly in playbookDir
+const (
+    listenAddr  = "127.0.0.1:8080"
+    playbookDir = "."
 )
 
 func main() {
@@ -13,15 +43,55 @@ func main() {
     http.HandleFunc("/execute-playbook", executePlaybookHandler)
     http.HandleFunc("/hosts", hostsHandler)
     http.HandleFunc("/task-status", taskStatusHandler)
+    http.HandleFunc("/diffs", diffsHandler)
     http.HandleFunc("/logs", logsHandler)
 
-    // Start the server on port 8080
-    fmt.Println("Starting server on :8080...")
-    if err := http.ListenAndServe(":8080", nil); err != nil {
+    // Start the server on port 8080 of this machine only
+    fmt.Printf("Starting server on %s...\n", listenAddr)
+    if err := http.ListenAndServe(listenAddr, localOnly(http.DefaultServeMux)); err != nil {
         log.Fatalf("Server failed to start: %v", err)
     }
 }
 
+// Rejects requests that come from another site or are addressed to another
+// host name, so a page open in the browser cannot drive the server
+func localOnly(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !isLocalHost(r.Host) {
+            http.Error(w, "Unknown host", http.StatusForbidden)
+            return
+        }
+        if origin := r.Header.Get("Origin"); origin != "" {
+            if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+                http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+                return
+            }
+        }
+        if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+            http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Reports whether host, as sent in a request, names this machine
+func isLocalHost(host string) bool {
+    if name, _, err := net.SplitHostPort(host); err == nil {
+        host = name
+    }
+    return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// Resolves a playbook name from a request to a file in playbookDir
+func playbookPath(name string) (string, error) {
+    ext := filepath.Ext(name)
+    if name == "" || filepath.Base(name) != name || (ext != ".yaml" && ext != ".yml") {
+        return "", fmt.Errorf("playbook must be the name of a .yaml or .yml file in the server directory")
+    }
+    return filepath.Join(playbookDir, name), nil
+}
+
 func homeHandler(w http.ResponseWriter, r *http.Request) {
     http.ServeFile(w, r, "index.html")
 }
@@ -30,8 +100,58 @@ func uploadPlaybookHandler(w http.ResponseWriter, r *http.Request) {
     fmt.Fprintln(w, "Playbook upload handler (placeholder)")
 }
 
+// Runs the named playbook and renders the result as text, or as JSON when
+// the request asks for it with format=json. A request made while another run
+// is going is turned away rather than mixed into its log
 func executePlaybookHandler(w http.ResponseWriter, r *http.Request) {
-    fmt.Fprintln(w, "Playbook execute handler (placeholder)")
+    if r.Method != http.MethodPost {
+        http.Error(w, "Use POST to execute a playbook", http.StatusMethodNotAllowed)
+        return
+    }
+
+    playbook, err := playbookPath(r.FormValue("playbook"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    var hosts []string
+    if value := strings.TrimSpace(r.FormValue("hosts")); value != "" {
+        hosts = strings.Split(value, ",")
+    }
+
+    runLogMu.Lock()
+    if running {
+        runLogMu.Unlock()
+        http.Error(w, "Another playbook is still running; try again once it finishes", http.StatusConflict)
+        return
+    }
+    running = true
+    runLog = nil
+    runLogMu.Unlock()
+    defer func() {
+        runLogMu.Lock()
+        running = false
+        runLogMu.Unlock()
+    }()
+
+    result, err := engine.RunPlaybook(playbook, engine.RunOptions{
+        Hosts:          hosts,
+        Check:          r.FormValue("check") == "true",
+        Diff:           r.FormValue("diff") == "true",
+        BecomePassword: r.FormValue("become_password"),
+        OnOutput:       recordOutput,
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    lastResultMu.Lock()
+    lastResult = result
+    lastResultMu.Unlock()
+
+    writeResult(w, r, result)
 }
 
 func hostsHandler(w http.ResponseWriter, r *http.Request) {
@@ -39,9 +159,71 @@ func hostsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func taskStatusHandler(w http.ResponseWriter, r *http.Request) {
-    fmt.Fprintln(w, "Task status handler (placeholder)")
+    lastResultMu.Lock()
+    result := lastResult
+    lastResultMu.Unlock()
+
+    if result == nil {
+        fmt.Fprintln(w, "No playbook has been executed yet.")
+        return
+    }
+    writeResult(w, r, result)
+}
+
+// Returns the file diffs of the most recent run as JSON
+func diffsHandler(w http.ResponseWriter, r *http.Request) {
+    lastResultMu.Lock()
+    result := lastResult
+    lastResultMu.Unlock()
+
+    diffs := []engine.TaskDiff{}
+    if result != nil {
+        diffs = result.Diffs()
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(diffs)
 }
 
+// Writes a run result with the same text rendering the CLIs use, or as JSON
+func writeResult(w http.ResponseWriter, r *http.Request, result *engine.RunResult) {
+    if r.FormValue("format") == "json" {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(result)
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    result.Print(w)
+}
+
+// Keeps an output line of the running playbook for /logs and writes it to
+// the server log
+func recordOutput(line engine.OutputLine) {
+    runLogMu.Lock()
+    runLog = append(runLog, line)
+    runLogMu.Unlock()
+    log.Printf("[%s] %s (%s): %s", line.Host, line.Task, line.Stream, line.Text)
+}
+
+// Returns the output lines of the current or most recent run as text, or as
+// JSON when the request asks for it with format=json. since=N skips the
+// first N lines, so a page can poll for new ones while a run is going
 func logsHandler(w http.ResponseWriter, r *http.Request) {
-    fmt.Fprintln(w, "Logs handler (placeholder)")
+    since, _ := strconv.Atoi(r.FormValue("since"))
+
+    runLogMu.Lock()
+    lines := []engine.OutputLine{}
+    if since >= 0 && since < len(runLog) {
+        lines = append(lines, runLog[since:]...)
+    }
+    runLogMu.Unlock()
+
+    if r.FormValue("format") == "json" {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(lines)
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    for _, line := range lines {
+        fmt.Fprintf(w, "[%s] %s: %s\n", line.Host, line.Task, line.Text)
+    }
 }
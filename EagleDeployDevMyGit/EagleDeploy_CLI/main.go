@@ -3,84 +3,40 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
-)
 
-// Structs for the YAML structure
-type Task struct {
-	Name    string `yaml:"name"`
-	Command string `yaml:"command"`
-}
-type Playbook struct {
-	Name     string   `yaml:"name"`
-	Version  string   `yaml:"version"`
-	Tasks    []Task   `yaml:"tasks"`
-	Hosts    []string `yaml:"hosts"`
-	Settings map[string]int `yaml:"settings"`
-}
+	"golang.org/x/term"
 
-// Function to execute the YAML file by parsing its content
-func executeYAML(ymlFilePath string, targetHosts []string) {
-	data, err := ioutil.ReadFile(ymlFilePath)
-	if err != nil {
-		log.Fatalf("Error reading YAML file: %v", err)
-	}
+	"EagleDeploy/engine"
+)
 
-	var playbook Playbook
-	err = yaml.Unmarshal(data, &playbook)
+// Function to execute the YAML file and print the result of every task
+func executeYAML(ymlFilePath string, targetHosts []string, becomePassword string) {
+	result, err := engine.RunPlaybook(ymlFilePath, engine.RunOptions{
+		Hosts:          targetHosts,
+		BecomePassword: becomePassword,
+		Output:         os.Stdout,
+		ErrorOutput:    os.Stderr,
+	})
 	if err != nil {
-		log.Fatalf("Error parsing YAML file: %v", err)
-	}
-
-	if len(playbook.Tasks) == 0 {
-		log.Fatalf("Error: No tasks found in the playbook.")
-	}
-
-	var hosts []string
-	if len(targetHosts) > 0 {
-		for _, host := range playbook.Hosts {
-			if contains(targetHosts, host) {
-				hosts = append(hosts, host)
-			}
-		}
-		if len(hosts) == 0 {
-			log.Fatalf("Error: No matching hosts found in the playbook for the provided targets.")
-		}
-	} else {
-		hosts = playbook.Hosts
-	}
-
-	fmt.Printf("Executing Playbook: %s (Version: %s) on Hosts: %v\n", playbook.Name, playbook.Version, hosts)
-	for _, task := range playbook.Tasks {
-		if task.Command == "" {
-			log.Fatalf("Error: Task '%s' has no command to execute.", task.Name)
-		}
-
-		fmt.Printf("Executing Task: %s\n", task.Name)
-		cmd := exec.Command("bash", "-c", task.Command)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			fmt.Printf("Error executing task '%s': %v\n", task.Name, err)
-		} else {
-			fmt.Printf("Output of '%s':\n%s\n", task.Name, string(output))
-		}
+		fmt.Printf("\nError: %v\n", err)
+		return
 	}
+	result.Print(os.Stdout)
 }
 
-// Helper function to check if a slice contains a specific element
-func contains(slice []string, item string) bool {
-	for _, v := range slice {
-		if v == item {
-			return true
-		}
+// Function to ask for the become password without echoing it
+func askBecomePass() (string, error) {
+	fmt.Print("BECOME password (leave empty if no task uses become): ")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("unable to read become password: %v", err)
 	}
-	return false
+	return string(password), nil
 }
 
 // Function to list YAML files based on a keyword in the current directory
@@ -89,6 +45,12 @@ func listYAMLFiles(keyword string) {
 		if err != nil {
 			return err
 		}
+		if info.IsDir() && filepath.Base(filepath.Dir(path)) == "roles" {
+			if strings.Contains(info.Name(), keyword) {
+				fmt.Println("Found role:", path)
+			}
+			return nil
+		}
 		if filepath.Ext(path) == ".yaml" || filepath.Ext(path) == ".yml" {
 			if strings.Contains(path, keyword) {
 				fmt.Println("Found YAML file:", path)
@@ -134,15 +96,21 @@ func main() {
 				if ymlFilePath == "back" {
 					break
 				}
-				
+
 				fmt.Print("Enter comma-separated list of target hosts (leave empty for all in playbook): ")
 				hosts, _ := reader.ReadString('\n')
 				hosts = strings.TrimSpace(hosts)
 				if hosts != "" {
 					targetHosts = strings.Split(hosts, ",")
 				}
-				
-				executeYAML(ymlFilePath, targetHosts)
+
+				becomePassword, err := askBecomePass()
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					continue
+				}
+
+				executeYAML(ymlFilePath, targetHosts, becomePassword)
 			}
 
 		case 2: // List YAML Files
@@ -186,7 +154,7 @@ func main() {
 		case 6: // Help
 			fmt.Println("Help Page:")
 			fmt.Println("-e <yaml-file>: Execute the specified YAML file.")
-			fmt.Println("-l <keyword>: List YAML files or related names in the EagleDeployment directory.")
+			fmt.Println("-l <keyword>: List YAML files and roles matching the keyword in the EagleDeployment directory.")
 			fmt.Println("-hosts <comma-separated-hosts>: Specify hosts to target (only with -e).")
 			fmt.Println("-h: Display this help page.")
 
@@ -4,4 +4,12 @@ go 1.23.2
 
 require gopkg.in/yaml.v2 v2.4.0
 
-require golang.org/x/crypto v0.29.0 // indirect
+require (
+	EagleDeploy v0.0.0
+	golang.org/x/crypto v0.29.0
+	golang.org/x/term v0.26.0
+)
+
+require golang.org/x/sys v0.27.0 // indirect
+
+replace EagleDeploy => ../EagleDeploy_Initial_Setup
@@ -5,27 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
-	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
-)
 
-type Task struct {
-	Name    string `yaml:"name"`
-	Command string `yaml:"command"`
-}
+	"golang.org/x/term"
 
-type Playbook struct {
-	Name     string   `yaml:"name"`
-	Version  string   `yaml:"version"`
-	Tasks    []Task   `yaml:"tasks"`
-	Hosts    []string `yaml:"hosts"`
-	Settings map[string]int `yaml:"settings"`
-}
+	"EagleDeploy/engine"
+)
 
 type User struct {
 	Username     string `json:"username"`
@@ -125,62 +114,75 @@ func displayMenu() int {
 	return choice
 }
 
-// Function to execute the YAML file by parsing its content
-func executeYAML(ymlFilePath string, targetHosts []string) {
-	data, err := ioutil.ReadFile(ymlFilePath)
+// Function to execute the YAML file and print the result of every task
+func executeYAML(ymlFilePath string, options engine.RunOptions) {
+	options.Output = os.Stdout
+	options.ErrorOutput = os.Stderr
+	result, err := engine.RunPlaybook(ymlFilePath, options)
 	if err != nil {
-		log.Fatalf("Error reading YAML file: %v", err)
+		fmt.Printf("\nError: %v\n", err)
+		return
 	}
+	result.Print(os.Stdout)
+}
 
-	var playbook Playbook
-	err = yaml.Unmarshal(data, &playbook)
+// Function to list the tags of every task in a YAML file
+func listTags(ymlFilePath string) {
+	plays, err := engine.LoadPlays(ymlFilePath)
 	if err != nil {
-		log.Fatalf("Error parsing YAML file: %v", err)
+		fmt.Printf("\nError: %v\n", err)
+		return
 	}
-
-	if len(playbook.Tasks) == 0 {
-		log.Fatalf("Error: No tasks found in the playbook.")
+	for _, play := range plays {
+		fmt.Printf("Play: %s\n", play.Name)
+		for _, task := range play.Tasks {
+			fmt.Printf("  %s: %v\n", task.Name, []string(task.Tags))
+		}
+		fmt.Printf("All tags: %v\n", play.Tags())
 	}
+}
 
-	var hosts []string
-	if len(targetHosts) > 0 {
-		for _, host := range playbook.Hosts {
-			if contains(targetHosts, host) {
-				hosts = append(hosts, host)
+// Function to ask before each task in step mode
+func stepPrompt(reader *bufio.Reader) func(task string) engine.StepAnswer {
+	return func(task string) engine.StepAnswer {
+		for {
+			fmt.Printf("Perform task: %s (y)es/(n)o/(c)ontinue: ", task)
+			answer, err := reader.ReadString('\n')
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "y", "yes":
+				return engine.StepYes
+			case "c", "continue":
+				return engine.StepContinue
+			case "n", "no":
+				return engine.StepNo
+			}
+			if err != nil {
+				return engine.StepNo
 			}
 		}
-		if len(hosts) == 0 {
-			log.Fatalf("Error: No matching hosts found in the playbook for the provided targets.")
-		}
-	} else {
-		hosts = playbook.Hosts
 	}
+}
 
-	fmt.Printf("Executing Playbook: %s (Version: %s) on Hosts: %v\n", playbook.Name, playbook.Version, hosts)
-	for _, task := range playbook.Tasks {
-		if task.Command == "" {
-			log.Fatalf("Error: Task '%s' has no command to execute.", task.Name)
-		}
-
-		fmt.Printf("Executing Task: %s\n", task.Name)
-		cmd := exec.Command("bash", "-c", task.Command)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			fmt.Printf("Error executing task '%s': %v\n", task.Name, err)
-		} else {
-			fmt.Printf("Output of '%s':\n%s\n", task.Name, string(output))
-		}
+// Function to ask for the become password without echoing it
+func askBecomePass() (string, error) {
+	fmt.Print("\nBECOME password (leave empty if no task uses become): ")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("unable to read become password: %v", err)
 	}
+	return string(password), nil
 }
 
-// Helper function to check if a slice contains a specific element
-func contains(slice []string, item string) bool {
-	for _, v := range slice {
-		if v == item {
-			return true
+// Function to split a comma-separated answer into trimmed items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
 	}
-	return false
+	return items
 }
 
 // Function to list YAML files based on a keyword in the current directory
@@ -189,6 +191,12 @@ func listYAMLFiles(keyword string) {
 		if err != nil {
 			return err
 		}
+		if info.IsDir() && filepath.Base(filepath.Dir(path)) == "roles" {
+			if strings.Contains(info.Name(), keyword) {
+				fmt.Println("Found role:", path)
+			}
+			return nil
+		}
 		if filepath.Ext(path) == ".yaml" || filepath.Ext(path) == ".yml" {
 			if strings.Contains(path, keyword) {
 				fmt.Println("Found YAML file:", path)
@@ -256,7 +264,49 @@ func main() {
 								targetHosts = strings.Split(hosts, ",")
 							}
 
-							executeYAML(ymlFilePath, targetHosts)
+							var tags string
+							for {
+								fmt.Print("\nEnter comma-separated tags to run (leave empty for all, 'list' to show the playbook's tags): ")
+								tags, _ = reader.ReadString('\n')
+								tags = strings.TrimSpace(tags)
+								if tags != "list" {
+									break
+								}
+								listTags(ymlFilePath)
+							}
+
+							fmt.Print("\nEnter comma-separated tags to skip (leave empty to skip none): ")
+							skipTags, _ := reader.ReadString('\n')
+
+							fmt.Print("\nEnter the name of the task to start at (leave empty to start at the beginning): ")
+							startAtTask, _ := reader.ReadString('\n')
+
+							fmt.Print("\nConfirm each task before it runs? (y/n): ")
+							step, _ := reader.ReadString('\n')
+							step = strings.TrimSpace(step)
+
+							fmt.Print("\nDry run only, without changing any host? (y/n): ")
+							dryRun, _ := reader.ReadString('\n')
+							dryRun = strings.TrimSpace(dryRun)
+
+							becomePassword, err := askBecomePass()
+							if err != nil {
+								fmt.Printf("\nError: %v\n", err)
+								continue
+							}
+
+							options := engine.RunOptions{
+								Hosts:          targetHosts,
+								Check:          dryRun == "y",
+								Tags:           splitList(tags),
+								SkipTags:       splitList(skipTags),
+								StartAtTask:    strings.TrimSpace(startAtTask),
+								BecomePassword: becomePassword,
+							}
+							if step == "y" {
+								options.Step = stepPrompt(reader)
+							}
+							executeYAML(ymlFilePath, options)
 						}
 
 					case 2: // List YAML Files
@@ -298,8 +348,9 @@ func main() {
 					case 6: // Help
 						fmt.Println("Help Page:")
 						fmt.Println("-e <yaml-file>: Execute the specified YAML file.")
-						fmt.Println("-l <keyword>: List YAML files or related names in the EagleDeployment directory.")
+						fmt.Println("-l <keyword>: List YAML files and roles matching the keyword in the EagleDeployment directory.")
 						fmt.Println("-hosts <comma-separated-hosts>: Specify hosts to target (only with -e).")
+						fmt.Println("Dry run: when executing a YAML file, answer 'y' to \"Dry run only\" to see what would change without changing anything.")
 						fmt.Println("-h: Display this help page.")
 
 					case 0: // Logout
@@ -328,4 +379,4 @@ func main() {
 			fmt.Println("\nInvalid choice.")
 		}
 	}
-}
\ No newline at end of file
+}
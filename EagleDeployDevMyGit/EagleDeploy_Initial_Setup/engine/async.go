@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Async jobs let a command outlive the connection that started it. The
+// command is written to a job directory on the host and run there by a
+// detached wrapper, which keeps its output next to it and finally writes
+// its exit code to the rc file. Anyone who knows the job id can then check
+// on the job over a fresh connection, so a long upgrade never depends on
+// one SSH session staying up. A job's output is not streamed; it arrives
+// with the result.
+
+// asyncDir is where job directories live, relative to the login user's
+// home directory on the host.
+const asyncDir = ".eagledeploy_async"
+
+// DefaultPoll is how many seconds pass between checks on an async job when
+// the task does not set poll.
+const DefaultPoll = 15
+
+// AsyncStatusModule waits for an async job started earlier, usually with
+// poll: 0, and reports its result as if the task had run the command.
+type AsyncStatusModule struct {
+	JID string `yaml:"jid"`
+}
+
+// StartJob starts cmd detached from the connection and returns the job's
+// id. The command is killed if it is still running after limit.
+func (c *Communicator) StartJob(cmd string, limit time.Duration) (string, error) {
+	c = c.WithStreaming(nil)
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("unable to create job id: %v", err)
+	}
+	id := hex.EncodeToString(random)
+	dir := jobDir(id)
+
+	seconds := int(limit.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	wrapper := fmt.Sprintf("timeout %d bash %s/command > %s/stdout 2> %s/stderr < /dev/null; echo $? > %s/rc.tmp && mv %s/rc.tmp %s/rc",
+		seconds, dir, dir, dir, dir, dir, dir)
+	start := fmt.Sprintf("mkdir -p %s && cat > %s/command && { nohup bash -c %s > /dev/null 2>&1 < /dev/null & }",
+		dir, dir, shellQuote(wrapper))
+
+	output, err := c.RunCommandWithInput(context.Background(), start, strings.NewReader(cmd))
+	if err != nil {
+		return "", fmt.Errorf("unable to start async job: %s", strings.TrimSpace(output.Stderr))
+	}
+	return id, nil
+}
+
+// JobResult returns the result of a job and whether it has finished. Until
+// it has, the result is empty.
+func (c *Communicator) JobResult(id string) (CommandResult, bool, error) {
+	c = c.WithStreaming(nil)
+	if !validJobID(id) {
+		return CommandResult{}, false, fmt.Errorf("invalid async job id '%s'", id)
+	}
+	dir := jobDir(id)
+	cmd := fmt.Sprintf("if [ ! -d %s ]; then exit %d; elif [ -f %s/rc ]; then cat %s/rc; else echo running; fi",
+		dir, missingFileExit, dir, dir)
+	output, err := c.RunCommand(context.Background(), cmd)
+	if output.ExitCode == missingFileExit {
+		return CommandResult{}, false, fmt.Errorf("unknown async job '%s'", id)
+	}
+	if err != nil {
+		return CommandResult{}, false, fmt.Errorf("unable to check async job '%s': %s", id, strings.TrimSpace(output.Stderr))
+	}
+	status := strings.TrimSpace(output.Stdout)
+	if status == "running" {
+		return CommandResult{}, false, nil
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return CommandResult{}, false, fmt.Errorf("async job '%s' left an invalid exit code '%s'", id, status)
+	}
+
+	result := CommandResult{ExitCode: code}
+	for _, file := range []struct {
+		name string
+		out  *string
+	}{{"stdout", &result.Stdout}, {"stderr", &result.Stderr}} {
+		output, err := c.RunCommand(context.Background(), fmt.Sprintf("cat %s/%s", dir, file.name))
+		if err != nil {
+			return CommandResult{}, false, fmt.Errorf("unable to read %s of async job '%s': %s", file.name, id, strings.TrimSpace(output.Stderr))
+		}
+		*file.out = output.Stdout
+	}
+	return result, true, nil
+}
+
+// CleanupJob removes the files of a finished job from the host.
+func (c *Communicator) CleanupJob(id string) error {
+	c = c.WithStreaming(nil)
+	if !validJobID(id) {
+		return fmt.Errorf("invalid async job id '%s'", id)
+	}
+	output, err := c.RunCommand(context.Background(), "rm -rf "+jobDir(id))
+	if err != nil {
+		return fmt.Errorf("unable to remove async job '%s': %s", id, strings.TrimSpace(output.Stderr))
+	}
+	return nil
+}
+
+// jobDir returns the shell word for a job's directory. Job ids are checked
+// to be hex, so the word only needs quoting around $HOME.
+func jobDir(id string) string {
+	return `"$HOME/` + asyncDir + "/" + id + `"`
+}
+
+func validJobID(id string) bool {
+	if id == "" {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// poll returns the seconds between checks on the task's async job.
+func (t Task) poll() int {
+	if t.Poll == nil {
+		return DefaultPoll
+	}
+	return *t.Poll
+}
+
+// startJob starts the task's command as an async job without waiting for
+// it. The result carries the job id for a later async_status.
+func (e *Executor) startJob() TaskResult {
+	result := TaskResult{Task: e.task.Name, Status: StatusOK, pending: true}
+	id, err := e.communicator.StartJob(e.task.Command, time.Duration(e.task.Async)*time.Second)
+	if err != nil {
+		result.ExitCode, result.Error = -1, err.Error()
+		return e.task.failed(result)
+	}
+	result.JobID = id
+	result.Message = "started async job " + id
+	return result
+}
+
+// runJob starts the task's command as an async job and waits for it.
+func (e *Executor) runJob() (CommandResult, error) {
+	limit := time.Duration(e.task.Async) * time.Second
+	id, err := e.communicator.StartJob(e.task.Command, limit)
+	if err != nil {
+		return CommandResult{ExitCode: -1}, err
+	}
+	return e.waitJob(id, limit)
+}
+
+// waitJob checks on a job every poll seconds until it finishes, then
+// removes its files. A limit above zero bounds the wait. Exit code 124 is
+// how timeout reports a job killed for running past its async limit.
+func (e *Executor) waitJob(id string, limit time.Duration) (CommandResult, error) {
+	interval := time.Duration(e.task.poll()) * time.Second
+	if interval <= 0 {
+		interval = time.Duration(DefaultPoll) * time.Second
+	}
+	start := time.Now()
+	for {
+		command, finished, err := e.communicator.JobResult(id)
+		if err != nil {
+			return CommandResult{ExitCode: -1}, err
+		}
+		if finished {
+			if err := e.communicator.CleanupJob(id); err != nil {
+				return command, err
+			}
+			switch command.ExitCode {
+			case 0:
+			case 124:
+				return command, fmt.Errorf("async job %s ran past its time limit", id)
+			default:
+				return command, fmt.Errorf("command execution failed: exit status %d", command.ExitCode)
+			}
+			return command, nil
+		}
+		if limit > 0 && time.Since(start) > limit+interval {
+			return CommandResult{ExitCode: -1}, fmt.Errorf("gave up waiting for async job %s after %v", id, limit)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,277 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Become runs commands as another user. The password, when one is needed,
+// is only ever written to the command's standard input in answer to its
+// prompt, so it never shows up in a process list or in the output.
+//
+// The wrapped command prints a marker line before it starts. Until then the
+// communicator watches the output for the password prompt; once the marker
+// shows up, the command's own input follows. sudo reads the password from
+// standard input with a prompt of our choosing. su insists on a terminal, so
+// it runs under script(1), which gives it one; the input is then sent
+// base64 encoded so the terminal passes it through unchanged, and stdout
+// and stderr arrive together.
+
+// Become methods.
+const (
+	BecomeSudo = "sudo"
+	BecomeSu   = "su"
+)
+
+// Become is how commands switch user. An empty Method means sudo and an
+// empty User means root.
+type Become struct {
+	Method   string
+	User     string
+	Password string
+}
+
+// suPrompt matches the password prompt of su, which cannot be chosen.
+var suPrompt = regexp.MustCompile(`(?i)password[^:\n]*: ?$`)
+
+// WithBecome returns a communicator that shares c's connection but runs
+// every command as described by become, or as the login user if it is nil.
+func (c *Communicator) WithBecome(become *Become) *Communicator {
+	copied := *c
+	copied.become = become
+	return &copied
+}
+
+func (b *Become) method() string {
+	if b.Method == "" {
+		return BecomeSudo
+	}
+	return b.Method
+}
+
+func (b *Become) user() string {
+	if b.User == "" {
+		return "root"
+	}
+	return b.User
+}
+
+// runBecome runs cmd as c.become describes, writing the command's own
+// output to stdout and stderr.
+func (c *Communicator) runBecome(ctx context.Context, cmd string, input io.Reader, stdout, stderr io.Writer) (int, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return -1, fmt.Errorf("unable to prepare become: %v", err)
+	}
+	nonce := hex.EncodeToString(random)
+	w := &becomeWatcher{
+		become: c.become,
+		marker: "EAGLEDEPLOY-BECOME-" + nonce,
+		input:  input,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	var wrapped string
+	switch c.become.method() {
+	case BecomeSudo:
+		w.prompt = "[eagledeploy-sudo-" + nonce + "] password: "
+		wrapped = fmt.Sprintf("sudo -H -S -p %s -u %s bash -c %s",
+			shellQuote(w.prompt), shellQuote(c.become.user()), shellQuote("echo "+w.marker+"; "+cmd))
+	case BecomeSu:
+		w.terminal = true
+		w.stdout = &crlfWriter{w: stdout}
+		body := "bash -c " + shellQuote(cmd) + " < /dev/null"
+		if input != nil {
+			body = "base64 -d | bash -c " + shellQuote(cmd)
+		}
+		su := fmt.Sprintf("su -s /bin/bash -c %s %s",
+			shellQuote("stty -echo 2> /dev/null; echo "+w.marker+"; "+body), shellQuote(c.become.user()))
+		wrapped = "script -qec " + shellQuote(su) + " /dev/null"
+	default:
+		return -1, fmt.Errorf("unknown become method '%s'", c.become.Method)
+	}
+
+	stdin, writer, err := os.Pipe()
+	if err != nil {
+		return -1, fmt.Errorf("unable to prepare become: %v", err)
+	}
+	defer stdin.Close()
+	w.stdin = writer
+
+	code, err := c.run(ctx, wrapped, stdin, w.stream(false), w.stream(true))
+	w.finish()
+	if w.failure != "" && err != nil {
+		err = fmt.Errorf("%s", w.failure)
+	}
+	return code, err
+}
+
+// becomeWatcher answers the password prompt of a become command and sends
+// the command its input once the marker shows it has started.
+type becomeWatcher struct {
+	become   *Become
+	prompt   string
+	marker   string
+	terminal bool
+	input    io.Reader
+
+	mu       sync.Mutex
+	stdin    *os.File
+	closed   bool
+	started  bool
+	answered bool
+	failure  string
+	// head holds output from before the marker, which may hold the prompt.
+	head           [2]bytes.Buffer
+	stdout, stderr io.Writer
+	feeding        sync.WaitGroup
+}
+
+type becomeStream struct {
+	w      *becomeWatcher
+	stderr bool
+}
+
+func (w *becomeWatcher) stream(stderr bool) io.Writer {
+	return &becomeStream{w: w, stderr: stderr}
+}
+
+func (s *becomeStream) Write(p []byte) (int, error) {
+	w := s.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.started {
+		if s.stderr {
+			return w.stderr.Write(p)
+		}
+		return w.stdout.Write(p)
+	}
+
+	index := 0
+	if s.stderr {
+		index = 1
+	}
+	head := &w.head[index]
+	head.Write(p)
+
+	// sudo prompts on stderr, su on the terminal, which is stdout.
+	if s.stderr == !w.terminal {
+		w.checkPrompt(head)
+	}
+	if !s.stderr {
+		text := head.String()
+		if i := strings.Index(text, w.marker); i >= 0 {
+			if end := strings.IndexByte(text[i:], '\n'); end >= 0 {
+				w.started = true
+				w.stderr.Write(w.head[1].Bytes())
+				io.WriteString(w.stdout, text[i+end+1:])
+				head.Reset()
+				w.head[1].Reset()
+				w.sendInput()
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// checkPrompt answers a password prompt at the end of head and drops it
+// from the output. A second prompt means the password was wrong.
+func (w *becomeWatcher) checkPrompt(head *bytes.Buffer) {
+	text := head.String()
+	var found bool
+	if w.terminal {
+		if loc := suPrompt.FindStringIndex(text); loc != nil {
+			text, found = text[:loc[0]], true
+		}
+	} else if i := strings.Index(text, w.prompt); i >= 0 {
+		text, found = text[:i]+text[i+len(w.prompt):], true
+	}
+	if !found {
+		return
+	}
+	head.Reset()
+	head.WriteString(text)
+
+	switch {
+	case w.become.Password == "":
+		w.failure = "become password is required"
+		w.closeInput()
+	case w.answered:
+		w.failure = "incorrect become password"
+		w.closeInput()
+	default:
+		w.answered = true
+		io.WriteString(w.stdin, w.become.Password+"\n")
+	}
+}
+
+// sendInput sends the command its input in the background and then ends
+// it. Under su the terminal stays open until the command exits.
+func (w *becomeWatcher) sendInput() {
+	if w.input == nil {
+		if !w.terminal {
+			w.closeInput()
+		}
+		return
+	}
+	w.feeding.Add(1)
+	go func() {
+		defer w.feeding.Done()
+		if !w.terminal {
+			io.Copy(w.stdin, w.input)
+			w.mu.Lock()
+			w.closeInput()
+			w.mu.Unlock()
+			return
+		}
+		// Lines of base64 stay well below the terminal's line limit, and
+		// ^D at the start of a line ends the input.
+		chunk := make([]byte, 57)
+		for {
+			n, err := io.ReadFull(w.input, chunk)
+			if n > 0 {
+				if _, werr := io.WriteString(w.stdin, base64.StdEncoding.EncodeToString(chunk[:n])+"\n"); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		io.WriteString(w.stdin, "\x04")
+	}()
+}
+
+func (w *becomeWatcher) closeInput() {
+	if !w.closed {
+		w.closed = true
+		w.stdin.Close()
+	}
+}
+
+// finish closes the command's input once it has exited. Output from before
+// a marker that never came goes to stderr, where sudo and su explain why
+// they failed.
+func (w *becomeWatcher) finish() {
+	w.mu.Lock()
+	w.closeInput()
+	if !w.started {
+		if w.terminal {
+			text := strings.ReplaceAll(w.head[0].String(), "\r\n", "\n")
+			io.WriteString(w.stderr, strings.TrimLeft(text, "\n"))
+		}
+		w.stderr.Write(w.head[1].Bytes())
+	}
+	w.mu.Unlock()
+	w.feeding.Wait()
+}
@@ -0,0 +1,128 @@
+package engine
+
+import "fmt"
+
+// A block groups tasks so they can share when, tags and vars and handle
+// failure together. When a task in the block fails on a host, the rest of
+// the block is skipped there and the rescue tasks run instead; if they all
+// succeed, the failure counts as rescued and the host stays in the play.
+// The always tasks run after that either way, so a half-applied change can
+// be cleaned up before the host drops out.
+//
+// The block's when, tags, become settings, environment, chdir and vars are
+// copied onto every task inside it when the playbook is loaded, the same
+// way import_tasks passes them on, so each task is judged on its own and
+// tag selection works inside blocks.
+
+// isBlock reports whether t is a block. Tag selection can leave a block with
+// only rescue or always tasks, which is still a block.
+func (t Task) isBlock() bool {
+	return len(t.Block) > 0 || len(t.Rescue) > 0 || len(t.Always) > 0
+}
+
+// sections returns the task lists of a block, in the order they may run.
+func (t *Task) sections() []*[]Task {
+	return []*[]Task{&t.Block, &t.Rescue, &t.Always}
+}
+
+// mapBlock returns task with fn applied to every task in its block, rescue
+// and always lists. The lists are copied, so task may share them with the
+// playbook.
+func (t Task) mapBlock(fn func(Task) Task) Task {
+	if !t.isBlock() {
+		return t
+	}
+	for _, section := range t.sections() {
+		mapped := make([]Task, len(*section))
+		for i, child := range *section {
+			mapped[i] = fn(child)
+		}
+		*section = mapped
+	}
+	return t
+}
+
+// expandBlock resolves the imports inside a block and gives every task in it
+// what the block sets for its tasks; see inherit.
+func expandBlock(block Task, dir string, chain []string) (Task, error) {
+	own := Task{When: block.When, Tags: block.Tags, Vars: block.Vars,
+		Become: block.Become, BecomeUser: block.BecomeUser, BecomeMethod: block.BecomeMethod,
+		Environment: block.Environment, Chdir: block.Chdir}
+	for _, section := range block.sections() {
+		tasks, err := expandImports(*section, dir, chain)
+		if err != nil {
+			return Task{}, err
+		}
+		for i := range tasks {
+			tasks[i] = inherit(own, tasks[i])
+		}
+		*section = tasks
+	}
+	return block, nil
+}
+
+// validateBlock checks the parts of a task that only make sense for blocks.
+func (p *Playbook) validateBlock(task Task) error {
+	if !task.isBlock() {
+		return nil
+	}
+	if len(task.Block) == 0 {
+		return fmt.Errorf("task '%s' has rescue or always without a block", task.Name)
+	}
+	if task.Loop != nil {
+		return fmt.Errorf("block '%s' cannot loop", task.Name)
+	}
+	for _, section := range task.sections() {
+		if err := p.validateTasks(*section); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBlock runs a block on host and reports whether the host is still in the
+// play afterwards.
+func (s *Scheduler) runBlock(host string, block Task, communicator *Communicator) bool {
+	s.mu.Lock()
+	from := len(s.result.Host(host).Tasks)
+	s.mu.Unlock()
+
+	ok := s.runSection(host, block.Block, communicator)
+	if !ok && len(block.Rescue) > 0 && !s.isStopped() {
+		if failed := s.rescue(host, from); failed != nil {
+			s.mu.Lock()
+			fmt.Fprintf(s.output, "[%s] rescuing: %s\n", host, displayName(block))
+			s.mu.Unlock()
+			vars := s.vars[host]
+			vars["ansible_failed_task"] = map[string]interface{}{"name": failed.Task}
+			vars["ansible_failed_result"] = failed.Vars()
+			ok = s.runSection(host, block.Rescue, communicator)
+		}
+	}
+	if len(block.Always) > 0 && !s.runSection(host, block.Always, communicator) {
+		ok = false
+	}
+	return ok
+}
+
+func (s *Scheduler) runSection(host string, tasks []Task, communicator *Communicator) bool {
+	for _, task := range tasks {
+		if s.isStopped() || !s.runTask(host, task, communicator) {
+			return false
+		}
+	}
+	return true
+}
+
+// rescue marks the failures host has had since its result number from as
+// rescued and returns the last of them, or nil if the host is unreachable
+// instead, which no rescue can help.
+func (s *Scheduler) rescue(host string, from int) *TaskResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.result.Host(host)
+	if h.Status == StatusUnreachable {
+		return nil
+	}
+	return h.rescue(from)
+}
@@ -0,0 +1,216 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Target describes how to reach a single host.
+type Target struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	KeyFile  string
+	Local    bool
+
+	// KnownHostsFile lists the host keys to accept, ~/.ssh/known_hosts if
+	// empty; see hostkeys.go.
+	KnownHostsFile   string
+	SkipHostKeyCheck bool
+}
+
+type Communicator struct {
+	target Target
+	client *ssh.Client
+	become *Become
+
+	// environment and dir are applied to every command; see environment.go.
+	environment map[string]string
+	dir         string
+	// onLine receives the output of every command; see stream.go.
+	onLine func(stream, line string)
+}
+
+func NewCommunicator(target Target) *Communicator {
+	return &Communicator{target: target}
+}
+
+func (c *Communicator) Connect() error {
+	if c.target.Local {
+		return nil
+	}
+
+	var auth []ssh.AuthMethod
+	if c.target.KeyFile != "" {
+		key, err := ioutil.ReadFile(c.target.KeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to read key file %s: %v", c.target.KeyFile, err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("unable to parse key file %s: %v", c.target.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if c.target.Password != "" {
+		auth = append(auth, ssh.Password(c.target.Password))
+	}
+
+	port := c.target.Port
+	if port == 0 {
+		port = 22
+	}
+	address := net.JoinHostPort(c.target.Host, strconv.Itoa(port))
+	check, algorithms, err := hostKeyCheck(c.target, address)
+	if err != nil {
+		return err
+	}
+	config := &ssh.ClientConfig{
+		User:              c.target.User,
+		Auth:              auth,
+		HostKeyCallback:   check,
+		HostKeyAlgorithms: algorithms,
+		Timeout:           10 * time.Second,
+	}
+	client, err := ssh.Dial("tcp", address, config)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", c.target.Host, err)
+	}
+	c.client = client
+	return nil
+}
+
+func (c *Communicator) Disconnect() {
+	if c.client != nil {
+		c.client.Close()
+	}
+}
+
+// alive reports whether the connection still works, asking the server to
+// answer a keepalive.
+func (c *Communicator) alive() bool {
+	if c.client == nil {
+		return true
+	}
+	_, _, err := c.client.SendRequest("keepalive@openssh.com", true, nil)
+	return err == nil
+}
+
+// CommandResult is what a finished command left behind on its host.
+type CommandResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// RunCommand runs cmd on the target. The output and exit code are returned
+// even when the command fails so callers can show them. When ctx is
+// cancelled the command is killed, locally or on the remote host, and the
+// exit code is -1.
+func (c *Communicator) RunCommand(ctx context.Context, cmd string) (CommandResult, error) {
+	return c.RunCommandWithInput(ctx, cmd, nil)
+}
+
+// RunCommandWithInput is RunCommand with input connected to the command's
+// standard input, so data such as file contents never shows up in the
+// command line. The environment and directory set with WithEnvironment
+// apply, with become set the command runs as another user, see become.go,
+// and WithStreaming passes the output on while the command runs.
+func (c *Communicator) RunCommandWithInput(ctx context.Context, cmd string, input io.Reader) (CommandResult, error) {
+	cmd = c.withEnvironment(cmd)
+	var stdout, stderr bytes.Buffer
+	out, errs, flush := c.sinks(&stdout, &stderr)
+	var code int
+	var err error
+	if c.become != nil {
+		code, err = c.runBecome(ctx, cmd, input, out, errs)
+	} else {
+		code, err = c.run(ctx, cmd, input, out, errs)
+	}
+	flush()
+	return CommandResult{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: code}, err
+}
+
+// run runs cmd with the given standard streams and returns its exit code.
+// An *os.File as stdin is handed to the command as is, so whoever writes to
+// it decides when the command sees the end of its input.
+func (c *Communicator) run(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if c.target.Local {
+		command := exec.CommandContext(ctx, "bash", "-c", cmd)
+		command.Stdin = stdin
+		command.Stdout = stdout
+		command.Stderr = stderr
+		killProcessGroup(command)
+		command.WaitDelay = time.Second
+		err := command.Run()
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		if err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return exitErr.ExitCode(), fmt.Errorf("command execution failed: %v", err)
+			}
+			return -1, fmt.Errorf("command execution failed: %v", err)
+		}
+		return 0, nil
+	}
+
+	session, err := c.client.NewSession()
+	if err != nil {
+		return -1, fmt.Errorf("failed to create session: %v", err)
+	}
+	defer session.Close()
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if file, ok := stdin.(*os.File); ok {
+		// Session.Run waits until stdin is drained, so copy it separately.
+		pipe, err := session.StdinPipe()
+		if err != nil {
+			return -1, fmt.Errorf("failed to open stdin: %v", err)
+		}
+		go func() {
+			io.Copy(pipe, file)
+			pipe.Close()
+		}()
+	} else {
+		session.Stdin = stdin
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(cmd)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Closing the channel alone leaves the process running on servers
+		// that ignore signals, but it always unblocks Run.
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		<-done
+		return -1, ctx.Err()
+	}
+
+	if err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitStatus(), fmt.Errorf("command execution failed: %v", err)
+		}
+		return -1, fmt.Errorf("command execution failed: %v", err)
+	}
+	return 0, nil
+}
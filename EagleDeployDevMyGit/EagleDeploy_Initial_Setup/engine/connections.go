@@ -0,0 +1,96 @@
+package engine
+
+import "sync"
+
+// A host is connected once per batch rather than once per task: the first
+// task that needs a host opens the connection and later tasks, fact
+// gathering, handlers and delegation to the host reuse it until the batch
+// ends. At most settings.connections connections stay open, so the number
+// of file descriptors is bounded however many hosts a batch has; hosts past
+// the limit connect for each use and disconnect again, as they would
+// without reuse. serial keeps batches below the limit when that matters.
+
+// DefaultConnections is how many connections are kept open when the
+// playbook does not set settings.connections.
+const DefaultConnections = 100
+
+// connections hands out the open connection of a host, connecting first if
+// there is none. A kept connection may be used by several workers at once,
+// for example by a host's own tasks and by tasks delegated to it.
+type connections struct {
+	limit int
+
+	mu   sync.Mutex
+	open map[string]*connection
+}
+
+// connection is a kept connection. ready is closed once the connection
+// attempt is over, with err telling how it went.
+type connection struct {
+	communicator *Communicator
+	ready        chan struct{}
+	err          error
+}
+
+func newConnections(limit int) *connections {
+	return &connections{limit: limit, open: make(map[string]*connection)}
+}
+
+// get returns a connected communicator for target and the function to call
+// once it is no longer needed.
+func (p *connections) get(target Target) (*Communicator, func(), error) {
+	p.mu.Lock()
+	c, ok := p.open[target.Host]
+	if ok {
+		p.mu.Unlock()
+		<-c.ready
+		if c.err == nil && c.communicator.alive() {
+			return c.communicator, func() {}, nil
+		}
+		// The connection dropped since it was opened; connect again.
+		p.mu.Lock()
+		if p.open[target.Host] == c {
+			delete(p.open, target.Host)
+			if c.err == nil {
+				c.communicator.Disconnect()
+			}
+		}
+	}
+
+	keep := len(p.open) < p.limit
+	c = &connection{communicator: NewCommunicator(target), ready: make(chan struct{})}
+	if keep {
+		p.open[target.Host] = c
+	}
+	p.mu.Unlock()
+
+	c.err = c.communicator.Connect()
+	close(c.ready)
+	if c.err != nil {
+		if keep {
+			p.mu.Lock()
+			if p.open[target.Host] == c {
+				delete(p.open, target.Host)
+			}
+			p.mu.Unlock()
+		}
+		return nil, nil, c.err
+	}
+	if !keep {
+		return c.communicator, c.communicator.Disconnect, nil
+	}
+	return c.communicator, func() {}, nil
+}
+
+// closeAll disconnects every kept connection. Nothing may use them anymore.
+func (p *connections) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for host, c := range p.open {
+		<-c.ready
+		if c.err == nil {
+			c.communicator.Disconnect()
+		}
+		delete(p.open, host)
+	}
+}
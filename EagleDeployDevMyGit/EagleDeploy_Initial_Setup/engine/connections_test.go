@@ -0,0 +1,47 @@
+package engine
+
+import "testing"
+
+func TestConnectionsReuse(t *testing.T) {
+	p := newConnections(2)
+	get := func(host string) *Communicator {
+		t.Helper()
+		communicator, release, err := p.get(Target{Host: host, Local: true})
+		if err != nil {
+			t.Fatalf("get(%s): %v", host, err)
+		}
+		release()
+		return communicator
+	}
+
+	a, b := get("a"), get("b")
+	if get("a") != a || get("b") != b {
+		t.Error("kept connections were not reused")
+	}
+	// Past the limit a host gets a connection of its own every time.
+	if get("c") == get("c") {
+		t.Error("connection past the limit was kept")
+	}
+	if len(p.open) != 2 {
+		t.Errorf("%d connections kept, want 2", len(p.open))
+	}
+
+	p.closeAll()
+	if len(p.open) != 0 {
+		t.Errorf("%d connections kept after closeAll, want 0", len(p.open))
+	}
+	if get("a") == a {
+		t.Error("connection was reused after closeAll")
+	}
+}
+
+func TestConnectionsFailure(t *testing.T) {
+	p := newConnections(2)
+	_, _, err := p.get(Target{Host: "127.0.0.1", Port: 1, KeyFile: "/nonexistent"})
+	if err == nil {
+		t.Fatal("get succeeded, want an error")
+	}
+	if len(p.open) != 0 {
+		t.Errorf("failed connection was kept")
+	}
+}
@@ -0,0 +1,82 @@
+package engine
+
+import "fmt"
+
+// Delegation runs a task for a host somewhere else: delegate_to names the
+// machine that runs it, and local_action is a command for the machine the
+// playbook runs from. The task still belongs to the original host: it sees
+// that host's variables, and its result, register and notify count there.
+//
+// run_once runs a task on the first host that gets to it in each batch.
+// The other hosts skip it but still get the result under its register name,
+// and their results say which host ran it.
+
+// delegateLocal is where local_action runs.
+const delegateLocal = "localhost"
+
+// delegate returns the host that runs the task in place of the one it is
+// for, as a template, or "" if the task runs on its own host.
+func (t Task) delegate() string {
+	if t.LocalAction != "" {
+		return delegateLocal
+	}
+	return t.DelegateTo
+}
+
+// connectDelegate returns the connection to the host the task is delegated
+// to, if any, from the batch's connections. It returns the delegate's name
+// and communicator, or "" and communicator unchanged for a task that is not
+// delegated, and the function to call once the task is done with it.
+func (s *Scheduler) connectDelegate(task Task, vars Vars, communicator *Communicator) (string, *Communicator, func(), error) {
+	if task.delegate() == "" {
+		return "", communicator, func() {}, nil
+	}
+	delegate, err := Render(task.delegate(), vars)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("unable to render delegate_to: %v", err)
+	}
+	delegated, release, err := s.connections.get(s.playbook.Target(delegate))
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("unable to reach delegate %s: %v", delegate, err)
+	}
+	return delegate, delegated, release, nil
+}
+
+// onceResult is the outcome of a run_once task, shared with the hosts that
+// skip it. done is closed once vars are set.
+type onceResult struct {
+	host string
+	done chan struct{}
+	vars map[string]interface{}
+}
+
+// claimOnce returns the shared outcome of a run_once task and whether host
+// is the one that runs it.
+func (s *Scheduler) claimOnce(host string, task Task) (*onceResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if once, ok := s.once[task.id]; ok {
+		return once, false
+	}
+	once := &onceResult{host: host, done: make(chan struct{})}
+	s.once[task.id] = once
+	return once, true
+}
+
+// resetOnce lets run_once tasks run again, for the next batch.
+func (s *Scheduler) resetOnce() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.once = make(map[string]*onceResult)
+}
+
+// numberTasks gives every task, down to those in blocks, an id that is the
+// same for every host, so run_once can tell which tasks already ran.
+func numberTasks(tasks []Task, prefix string) {
+	for i := range tasks {
+		tasks[i].id = fmt.Sprintf("%s.%d", prefix, i)
+		for j, section := range tasks[i].sections() {
+			numberTasks(*section, fmt.Sprintf("%s.%d", tasks[i].id, j))
+		}
+	}
+}
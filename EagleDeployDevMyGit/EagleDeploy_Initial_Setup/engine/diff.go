@@ -0,0 +1,234 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// maxDiffCells bounds the line comparison table. Larger files still get a
+// correct diff, just a coarser one that replaces the changed middle whole.
+const maxDiffCells = 4000000
+
+// FileDiff is the change a task makes, or would make in check mode, to a
+// file on a host. The hunks carry the same information as Unified for
+// callers that render diffs themselves, such as the web UI.
+type FileDiff struct {
+	Path   string     `json:"path"`
+	Before string     `json:"before"`
+	After  string     `json:"after"`
+	Hunks  []DiffHunk `json:"hunks"`
+}
+
+// DiffHunk is one block of a unified diff. Every line starts with ' ' for
+// context, '-' for a removed line or '+' for an added one. As in unified
+// diff, a line that ends its file without a newline is followed by the line
+// "\ No newline at end of file".
+type DiffHunk struct {
+	OldStart int      `json:"old_start"`
+	OldLines int      `json:"old_lines"`
+	NewStart int      `json:"new_start"`
+	NewLines int      `json:"new_lines"`
+	Lines    []string `json:"lines"`
+}
+
+// NewFileDiff compares the old and new content of path line by line.
+func NewFileDiff(path, before, after string) *FileDiff {
+	ops := diffLines(diffSplit(before), diffSplit(after))
+	return &FileDiff{Path: path, Before: before, After: after, Hunks: hunks(ops)}
+}
+
+// Unified renders the diff in unified format.
+func (d *FileDiff) Unified() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- before: %s\n+++ after: %s\n", d.Path, d.Path)
+	for _, hunk := range d.Hunks {
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", hunk.OldStart, hunk.OldLines, hunk.NewStart, hunk.NewLines)
+		for _, line := range hunk.Lines {
+			sb.WriteString(line)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+func splitLines(text string) []string {
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// noNewline follows a line that ends its file without a newline.
+const noNewline = `\ No newline at end of file`
+
+// diffSplit splits text into lines that keep their newline, so a last line
+// without one differs from the same line with one.
+func diffSplit(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffOp is one line of an edit script: kept (' '), removed ('-') or
+// added ('+').
+type diffOp struct {
+	kind byte
+	text string
+}
+
+// diffLines turns a into b using a longest common subsequence of lines.
+// Common leading and trailing lines are matched first, which keeps the
+// table small for the usual few-line edit of a long config file.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+func diffMiddle(a, b []string) []diffOp {
+	var ops []diffOp
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+		return ops
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// hunks groups the changes of an edit script with diffContext lines of
+// context, merging changes that are close enough to share it.
+func hunks(ops []diffOp) []DiffHunk {
+	var result []DiffHunk
+	for start := 0; start < len(ops); {
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+
+		// A change at most 2*diffContext lines after the last one joins its
+		// hunk, as the context of both then meets.
+		last := first
+		for k := first; k < len(ops) && k <= last+1+2*diffContext; k++ {
+			if ops[k].kind != ' ' {
+				last = k
+			}
+		}
+
+		from := first - diffContext
+		if from < start {
+			from = start
+		}
+		if from < 0 {
+			from = 0
+		}
+		to := last + 1 + diffContext
+		if to > len(ops) {
+			to = len(ops)
+		}
+		result = append(result, hunk(ops, from, to))
+		start = to
+	}
+	return result
+}
+
+func hunk(ops []diffOp, from, to int) DiffHunk {
+	oldBefore, newBefore := 0, 0
+	for _, op := range ops[:from] {
+		if op.kind != '+' {
+			oldBefore++
+		}
+		if op.kind != '-' {
+			newBefore++
+		}
+	}
+
+	h := DiffHunk{}
+	for _, op := range ops[from:to] {
+		h.Lines = append(h.Lines, string(op.kind)+strings.TrimSuffix(op.text, "\n"))
+		if !strings.HasSuffix(op.text, "\n") {
+			h.Lines = append(h.Lines, noNewline)
+		}
+		if op.kind != '+' {
+			h.OldLines++
+		}
+		if op.kind != '-' {
+			h.NewLines++
+		}
+	}
+	h.OldStart, h.NewStart = oldBefore+1, newBefore+1
+	if h.OldLines == 0 {
+		h.OldStart = oldBefore
+	}
+	if h.NewLines == 0 {
+		h.NewStart = newBefore
+	}
+	return h
+}
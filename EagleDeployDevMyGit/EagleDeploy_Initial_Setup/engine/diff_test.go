@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// numbered returns the lines "1" to "n", each ending in a newline, with the
+// lines in replace swapped for their new text.
+func numbered(n int, replace map[int]string) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		line, ok := replace[i]
+		if !ok {
+			line = fmt.Sprint(i)
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
+
+func TestNewFileDiffHunks(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		want          []DiffHunk
+	}{
+		{
+			name:   "unchanged",
+			before: "a\nb\n",
+			after:  "a\nb\n",
+			want:   nil,
+		},
+		{
+			name:   "new file",
+			before: "",
+			after:  "a\nb\n",
+			want:   []DiffHunk{{0, 0, 1, 2, []string{"+a", "+b"}}},
+		},
+		{
+			name:   "emptied file",
+			before: "a\n",
+			after:  "",
+			want:   []DiffHunk{{1, 1, 0, 0, []string{"-a"}}},
+		},
+		{
+			name:   "change in the middle keeps three lines of context",
+			before: numbered(10, nil),
+			after:  numbered(10, map[int]string{5: "five"}),
+			want:   []DiffHunk{{2, 7, 2, 7, []string{" 2", " 3", " 4", "-5", "+five", " 6", " 7", " 8"}}},
+		},
+		{
+			name:   "change on the first line",
+			before: numbered(5, nil),
+			after:  numbered(5, map[int]string{1: "one"}),
+			want:   []DiffHunk{{1, 4, 1, 4, []string{"-1", "+one", " 2", " 3", " 4"}}},
+		},
+		{
+			name:   "appended line",
+			before: numbered(5, nil),
+			after:  numbered(5, nil) + "6\n",
+			want:   []DiffHunk{{3, 3, 3, 4, []string{" 3", " 4", " 5", "+6"}}},
+		},
+		{
+			name:   "changes six lines apart share a hunk",
+			before: numbered(20, nil),
+			after:  numbered(20, map[int]string{5: "five", 12: "twelve"}),
+			want: []DiffHunk{{2, 14, 2, 14, []string{
+				" 2", " 3", " 4", "-5", "+five", " 6", " 7", " 8", " 9", " 10", " 11",
+				"-12", "+twelve", " 13", " 14", " 15"}}},
+		},
+		{
+			name:   "changes seven lines apart get their own hunks",
+			before: numbered(20, nil),
+			after:  numbered(20, map[int]string{5: "five", 13: "thirteen"}),
+			want: []DiffHunk{
+				{2, 7, 2, 7, []string{" 2", " 3", " 4", "-5", "+five", " 6", " 7", " 8"}},
+				{10, 7, 10, 7, []string{" 10", " 11", " 12", "-13", "+thirteen", " 14", " 15", " 16"}},
+			},
+		},
+		{
+			name:   "removed line",
+			before: "a\nb\nc\n",
+			after:  "a\nc\n",
+			want:   []DiffHunk{{1, 3, 1, 2, []string{" a", "-b", " c"}}},
+		},
+		{
+			name:   "added newline at end of file",
+			before: "x",
+			after:  "x\n",
+			want:   []DiffHunk{{1, 1, 1, 1, []string{"-x", noNewline, "+x"}}},
+		},
+		{
+			name:   "removed newline at end of file",
+			before: "x\n",
+			after:  "x",
+			want:   []DiffHunk{{1, 1, 1, 1, []string{"-x", "+x", noNewline}}},
+		},
+		{
+			name:   "context line without newline",
+			before: "a\nb",
+			after:  "A\nb",
+			want:   []DiffHunk{{1, 2, 1, 2, []string{"-a", "+A", " b", noNewline}}},
+		},
+	}
+	for _, test := range tests {
+		diff := NewFileDiff("f", test.before, test.after)
+		if !reflect.DeepEqual(diff.Hunks, test.want) {
+			t.Errorf("%s: hunks = %#v, want %#v", test.name, diff.Hunks, test.want)
+		}
+	}
+}
+
+func TestFileDiffUnified(t *testing.T) {
+	got := NewFileDiff("/etc/app.conf", "port=80\nhost=a\n", "port=8080\nhost=a").Unified()
+	want := "--- before: /etc/app.conf\n" +
+		"+++ after: /etc/app.conf\n" +
+		"@@ -1,2 +1,2 @@\n" +
+		"-port=80\n" +
+		"-host=a\n" +
+		"+port=8080\n" +
+		"+host=a\n" +
+		"\\ No newline at end of file\n"
+	if got != want {
+		t.Errorf("Unified() = %q, want %q", got, want)
+	}
+}
+
+func TestDiffLinesLargeFallback(t *testing.T) {
+	// Past maxDiffCells the changed middle is replaced whole, but the common
+	// ends are still matched line by line.
+	var a, b []string
+	a = append(a, "head")
+	b = append(b, "head")
+	for i := 0; i < 2100; i++ {
+		a = append(a, fmt.Sprintf("a%d", i))
+		b = append(b, fmt.Sprintf("b%d", i))
+	}
+	a = append(a, "tail")
+	b = append(b, "tail")
+
+	ops := diffLines(a, b)
+	if len(ops) != 2+2*2100 {
+		t.Fatalf("got %d ops, want %d", len(ops), 2+2*2100)
+	}
+	if ops[0] != (diffOp{' ', "head"}) || ops[len(ops)-1] != (diffOp{' ', "tail"}) {
+		t.Errorf("common ends not kept: first %v, last %v", ops[0], ops[len(ops)-1])
+	}
+	if ops[1].kind != '-' || ops[2100].kind != '-' || ops[2101].kind != '+' {
+		t.Errorf("middle not replaced whole: %v %v %v", ops[1], ops[2100], ops[2101])
+	}
+}
@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A task's environment and working directory are applied by the command
+// line itself: the communicator puts exports and a cd in front of every
+// command. That works the same for local and SSH hosts, where servers
+// usually refuse to set variables, and it happens before become, so sudo
+// does not reset them.
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validateEnvironment(environment map[string]string) error {
+	for name, value := range environment {
+		if !envName.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name '%s'", name)
+		}
+		if _, err := parseTemplate(value); err != nil {
+			return fmt.Errorf("environment variable %s is invalid: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// mergeEnvironment returns base with override on top, or nil if both are
+// empty.
+func mergeEnvironment(base, override map[string]string) map[string]string {
+	if len(base) == 0 {
+		return override
+	}
+	merged := make(map[string]string, len(base)+len(override))
+	for name, value := range base {
+		merged[name] = value
+	}
+	for name, value := range override {
+		merged[name] = value
+	}
+	return merged
+}
+
+// environment renders the environment and chdir task runs with: the play's
+// environment with the task's on top.
+func (s *Scheduler) environment(task Task, vars Vars) (map[string]string, string, error) {
+	merged := mergeEnvironment(s.playbook.Environment, task.Environment)
+	environment := make(map[string]string, len(merged))
+	for name, value := range merged {
+		rendered, err := Render(value, vars)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to render environment variable %s: %v", name, err)
+		}
+		environment[name] = rendered
+	}
+	dir, err := Render(task.Chdir, vars)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to render chdir: %v", err)
+	}
+	return environment, dir, nil
+}
+
+// WithEnvironment returns a communicator that shares c's connection but
+// runs every command with environment set and in dir, if it is not empty.
+func (c *Communicator) WithEnvironment(environment map[string]string, dir string) *Communicator {
+	copied := *c
+	copied.environment = environment
+	copied.dir = dir
+	return &copied
+}
+
+// withEnvironment puts the exports and cd for c's environment and dir in
+// front of cmd.
+func (c *Communicator) withEnvironment(cmd string) string {
+	if len(c.environment) == 0 && c.dir == "" {
+		return cmd
+	}
+	names := make([]string, 0, len(c.environment))
+	for name := range c.environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "export %s=%s\n", name, shellQuote(c.environment[name]))
+	}
+	if c.dir != "" {
+		fmt.Fprintf(&sb, "cd %s || exit\n", shellQuote(c.dir))
+	}
+	sb.WriteString(cmd)
+	return sb.String()
+}
@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Executor runs a single task on a host that is already connected, retrying
+// failed attempts and killing attempts that run past the timeout.
+type Executor struct {
+	task         Task
+	vars         Vars
+	communicator *Communicator
+	notice       func(message string)
+
+	retries int
+	delay   time.Duration
+	backoff int
+	timeout time.Duration
+}
+
+// NewExecutor reads retries, delay, backoff and timeout from the playbook
+// settings, letting the task's own fields override them. vars are the host's
+// variables for changed_when and failed_when. Retry notices are passed to
+// notice, which may be called while other hosts run.
+func NewExecutor(task Task, settings map[string]int, vars Vars, communicator *Communicator, notice func(message string)) *Executor {
+	backoff := settings["backoff"]
+	if backoff < 1 {
+		backoff = 1
+	}
+	return &Executor{
+		task:         task,
+		vars:         vars,
+		communicator: communicator,
+		notice:       notice,
+		retries:      setting(task.Retries, settings, "retries", 0),
+		delay:        time.Duration(setting(task.Delay, settings, "delay", 1)) * time.Second,
+		backoff:      backoff,
+		timeout:      time.Duration(setting(task.Timeout, settings, "timeout", 0)) * time.Second,
+	}
+}
+
+// Execute runs the task and reports how it went. A raw command cannot tell
+// whether it changed anything, so every successful run counts as changed
+// unless changed_when says otherwise. An attempt that failed_when judges a
+// failure is retried like a non-zero exit.
+//
+// An async task with poll 0 only starts its job; see async.go.
+func (e *Executor) Execute() TaskResult {
+	if e.task.Async > 0 && e.task.poll() == 0 {
+		return e.startJob()
+	}
+	start := time.Now()
+	delay := e.delay
+	for attempt := 0; ; attempt++ {
+		command, err := e.attempt()
+		result := TaskResult{
+			Task:     e.task.Name,
+			Status:   StatusChanged,
+			ExitCode: command.ExitCode,
+			Stdout:   command.Stdout,
+			Stderr:   command.Stderr,
+		}
+		if err != nil {
+			result.Status = StatusFailed
+			result.Error = err.Error()
+		}
+		e.judge(&result)
+
+		if result.Status != StatusFailed || attempt >= e.retries {
+			result.Duration = time.Since(start)
+			if result.Status == StatusFailed {
+				return e.task.failed(result)
+			}
+			return result
+		}
+		e.notice(fmt.Sprintf("Task '%s' failed (%s), retrying in %v (%d/%d)",
+			e.task.Name, result.Error, delay, attempt+1, e.retries))
+		time.Sleep(delay)
+		delay *= time.Duration(e.backoff)
+	}
+}
+
+// judge applies changed_when and then failed_when to result.
+func (e *Executor) judge(result *TaskResult) {
+	if len(e.task.ChangedWhen) == 0 && len(e.task.FailedWhen) == 0 {
+		return
+	}
+	failed := result.Status == StatusFailed
+	changed := !failed
+
+	if len(e.task.ChangedWhen) > 0 {
+		ok, err := EvalCondition(e.task.ChangedWhen, e.registered(*result))
+		if err != nil {
+			result.Status, result.Error = StatusFailed, err.Error()
+			return
+		}
+		changed = ok
+		if !failed {
+			result.Status = StatusOK
+			if changed {
+				result.Status = StatusChanged
+			}
+		}
+	}
+
+	if len(e.task.FailedWhen) > 0 {
+		ok, err := EvalCondition(e.task.FailedWhen, e.registered(*result))
+		if err != nil {
+			result.Status, result.Error = StatusFailed, err.Error()
+			return
+		}
+		failed = ok
+	}
+
+	switch {
+	case failed:
+		result.Status = StatusFailed
+		if result.Error == "" {
+			result.Error = "failed_when condition was true"
+		}
+	case changed:
+		result.Status, result.Error = StatusChanged, ""
+	default:
+		result.Status, result.Error = StatusOK, ""
+	}
+}
+
+// registered returns the variables conditions see: the host's own plus the
+// result under the task's register: name.
+func (e *Executor) registered(result TaskResult) Vars {
+	if e.task.Register == "" {
+		return e.vars
+	}
+	return withVar(e.vars, e.task.Register, result.Vars())
+}
+
+// attempt runs the task's command once, bounded by the timeout if one is set.
+// Async tasks and async_status wait for their job instead, bounded by the
+// async limit or the timeout.
+func (e *Executor) attempt() (CommandResult, error) {
+	switch {
+	case e.task.Async > 0:
+		return e.runJob()
+	case e.task.AsyncStatus != nil:
+		return e.waitJob(e.task.AsyncStatus.JID, e.timeout)
+	}
+	ctx := context.Background()
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+
+	command, err := e.communicator.RunCommand(ctx, e.task.Command)
+	if ctx.Err() == context.DeadlineExceeded {
+		return command, fmt.Errorf("command timed out after %v", e.timeout)
+	}
+	return command, err
+}
+
+// setting picks a task override, then the playbook setting, then fallback.
+func setting(override *int, settings map[string]int, key string, fallback int) int {
+	if override != nil {
+		return *override
+	}
+	if value, ok := settings[key]; ok {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,1055 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Expressions are the small, Jinja-like language used by when: conditions
+// and {{ }} templates. They are parsed into a tree once and evaluated against
+// a host's variables, so nothing in them is ever handed to a shell. Supported
+// are literals
+// (numbers, 'strings', "strings", true, false, none, [lists]), variables with
+// .attribute and [index] access, arithmetic, comparisons, in / not in, and /
+// or / not, tests such as "x is defined" and filters such as "x | default(1)".
+
+// Expr is a parsed expression.
+type Expr struct {
+	src  string
+	root node
+}
+
+// ParseExpr parses src, reporting the position of the first syntax error.
+func ParseExpr(src string) (*Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", src, err)
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = p.errorf("unexpected %s", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", src, err)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression against vars.
+func (e *Expr) Eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := e.root.eval(vars)
+	if err != nil {
+		return nil, fmt.Errorf("error evaluating %q: %v", e.src, err)
+	}
+	if u, ok := value.(undefined); ok {
+		return nil, fmt.Errorf("error evaluating %q: %s", e.src, u)
+	}
+	return value, nil
+}
+
+// EvalBool evaluates the expression and converts the result to a boolean.
+func (e *Expr) EvalBool(vars map[string]interface{}) (bool, error) {
+	value, err := e.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	return truthy(value), nil
+}
+
+// EvalCondition evaluates conditions the way when: does: every one of them
+// has to be true.
+func EvalCondition(conditions []string, vars map[string]interface{}) (bool, error) {
+	for _, condition := range conditions {
+		expr, err := ParseExpr(condition)
+		if err != nil {
+			return false, err
+		}
+		ok, err := expr.EvalBool(vars)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// undefined stands in for a variable or attribute that does not exist. It
+// only survives tests and filters that expect it, such as "is defined" and
+// "default"; anything else reports it as an error.
+type undefined struct {
+	name string
+}
+
+func (u undefined) String() string {
+	return fmt.Sprintf("'%s' is undefined", u.name)
+}
+
+// Lexer
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenName
+	tokenOp
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s' at position %d", t.text, t.pos+1)
+}
+
+var operators = []string{"==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "(", ")", "[", "]", ".", ",", "|"}
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			text := src[start:i]
+			if strings.Contains(text, ".") {
+				f, err := strconv.ParseFloat(text, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid number '%s' at position %d", text, start+1)
+				}
+				tokens = append(tokens, token{tokenNumber, text, f, start})
+			} else {
+				n, err := strconv.Atoi(text)
+				if err != nil {
+					return nil, fmt.Errorf("invalid number '%s' at position %d", text, start+1)
+				}
+				tokens = append(tokens, token{tokenNumber, text, n, start})
+			}
+		case c == '\'' || c == '"':
+			start := i
+			var sb strings.Builder
+			i++
+			for ; i < len(src) && src[i] != c; i++ {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+					switch src[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(src[i])
+					}
+					continue
+				}
+				sb.WriteByte(src[i])
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string starting at position %d", start+1)
+			}
+			i++
+			tokens = append(tokens, token{tokenString, src[start:i], sb.String(), start})
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, token{tokenName, src[start:i], nil, start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{tokenOp, op, nil, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character '%c' at position %d", c, i+1)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+// Parser
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the operator or keyword text.
+func (p *parser) accept(text string) bool {
+	t := p.peek()
+	if (t.kind == tokenOp || t.kind == tokenName) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("expected '%s' but found %s", text, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf(format, args...)
+}
+
+func (p *parser) parseExpr() (node, error) {
+	return p.parseOr()
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.accept("not") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokenOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+		p.next()
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op: t.text, left: left, right: right}, nil
+	case t.kind == tokenName && t.text == "in":
+		p.next()
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op: "in", left: left, right: right}, nil
+	case t.kind == tokenName && t.text == "not" && p.tokens[p.pos+1].text == "in":
+		p.next()
+		p.next()
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: &binaryNode{op: "in", left: left, right: right}}, nil
+	case t.kind == tokenName && t.text == "is":
+		p.next()
+		negate := p.accept("not")
+		name := p.next()
+		if name.kind != tokenName {
+			return nil, p.errorf("expected a test name after 'is' but found %s", name)
+		}
+		if _, ok := tests[name.text]; !ok {
+			return nil, p.errorf("unknown test '%s' at position %d", name.text, name.pos+1)
+		}
+		return &testNode{operand: left, name: name.text, negate: negate}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parseAdditive() (node, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokenOp || (t.text != "+" && t.text != "-") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseMultiplicative() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokenOp || (t.text != "*" && t.text != "/" && t.text != "%") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.accept("-") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op: "-", left: &literalNode{value: 0}, right: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			name := p.next()
+			if name.kind != tokenName && name.kind != tokenNumber {
+				return nil, p.errorf("expected an attribute name after '.' but found %s", name)
+			}
+			n = &indexNode{target: n, index: &literalNode{value: name.text}}
+		case p.accept("["):
+			index, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = &indexNode{target: n, index: index}
+		case p.accept("|"):
+			name := p.next()
+			if name.kind != tokenName {
+				return nil, p.errorf("expected a filter name after '|' but found %s", name)
+			}
+			if _, ok := filters[name.text]; !ok {
+				return nil, p.errorf("unknown filter '%s' at position %d", name.text, name.pos+1)
+			}
+			var args []node
+			if p.accept("(") {
+				args, err = p.parseList(")")
+				if err != nil {
+					return nil, err
+				}
+			}
+			n = &filterNode{operand: n, name: name.text, args: args}
+		default:
+			return n, nil
+		}
+	}
+}
+
+// parseList parses comma separated expressions up to and including end.
+func (p *parser) parseList(end string) ([]node, error) {
+	var items []node
+	if p.accept(end) {
+		return items, nil
+	}
+	for {
+		item, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if p.accept(end) {
+			return items, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber, tokenString:
+		return &literalNode{value: t.value}, nil
+	case tokenName:
+		switch t.text {
+		case "true", "True":
+			return &literalNode{value: true}, nil
+		case "false", "False":
+			return &literalNode{value: false}, nil
+		case "none", "None", "null":
+			return &literalNode{value: nil}, nil
+		case "and", "or", "not", "in", "is":
+			return nil, p.errorf("unexpected %s", t)
+		}
+		return &variableNode{name: t.text}, nil
+	case tokenOp:
+		switch t.text {
+		case "(":
+			n, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		case "[":
+			items, err := p.parseList("]")
+			if err != nil {
+				return nil, err
+			}
+			return &listNode{items: items}, nil
+		}
+	}
+	return nil, p.errorf("unexpected %s", t)
+}
+
+// Evaluation
+
+type node interface {
+	eval(vars map[string]interface{}) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(vars map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+type variableNode struct {
+	name string
+}
+
+func (n *variableNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, ok := vars[n.name]
+	if !ok {
+		return undefined{n.name}, nil
+	}
+	return value, nil
+}
+
+type listNode struct {
+	items []node
+}
+
+func (n *listNode) eval(vars map[string]interface{}) (interface{}, error) {
+	list := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		value, err := evalDefined(item, vars)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+type indexNode struct {
+	target node
+	index  node
+}
+
+func (n *indexNode) eval(vars map[string]interface{}) (interface{}, error) {
+	target, err := n.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	index, err := evalDefined(n.index, vars)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := target.(undefined); ok {
+		return undefined{fmt.Sprintf("%s.%v", u.name, index)}, nil
+	}
+
+	switch t := target.(type) {
+	case map[string]interface{}:
+		value, ok := t[fmt.Sprint(index)]
+		if !ok {
+			return undefined{fmt.Sprint(index)}, nil
+		}
+		return value, nil
+	case []interface{}:
+		i, ok := toInt(index)
+		if !ok {
+			return nil, fmt.Errorf("list index must be a number, not %v", index)
+		}
+		if i < 0 {
+			i += len(t)
+		}
+		if i < 0 || i >= len(t) {
+			return undefined{fmt.Sprintf("index %v", index)}, nil
+		}
+		return t[i], nil
+	case string:
+		i, ok := toInt(index)
+		if !ok || i < 0 || i >= len(t) {
+			return undefined{fmt.Sprintf("index %v", index)}, nil
+		}
+		return string(t[i]), nil
+	}
+	return nil, fmt.Errorf("cannot look up %v in %s", index, typeName(target))
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := evalDefined(n.operand, vars)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(value), nil
+}
+
+type logicalNode struct {
+	op          string
+	left, right node
+}
+
+func (n *logicalNode) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := evalDefined(n.left, vars)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "and" && !truthy(left) || n.op == "or" && truthy(left) {
+		return truthy(left), nil
+	}
+	right, err := evalDefined(n.right, vars)
+	if err != nil {
+		return nil, err
+	}
+	return truthy(right), nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := evalDefined(n.left, vars)
+	if err != nil {
+		return nil, err
+	}
+	right, err := evalDefined(n.right, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		c, err := compare(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "in":
+		return contained(left, right)
+	case "+":
+		if l, ok := left.(string); ok {
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		}
+		if l, ok := left.([]interface{}); ok {
+			if r, ok := right.([]interface{}); ok {
+				return append(append([]interface{}{}, l...), r...), nil
+			}
+		}
+	}
+	return arithmetic(n.op, left, right)
+}
+
+type testNode struct {
+	operand node
+	name    string
+	negate  bool
+}
+
+func (n *testNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	result, err := tests[n.name](value)
+	if err != nil {
+		return nil, err
+	}
+	return result != n.negate, nil
+}
+
+type filterNode struct {
+	operand node
+	name    string
+	args    []node
+}
+
+func (n *filterNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, 0, len(n.args))
+	for _, arg := range n.args {
+		a, err := evalDefined(arg, vars)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	if u, ok := value.(undefined); ok && n.name != "default" && n.name != "d" {
+		return nil, fmt.Errorf("%s", u)
+	}
+	return filters[n.name](value, args)
+}
+
+// evalDefined evaluates n and turns an undefined result into an error.
+func evalDefined(n node, vars map[string]interface{}) (interface{}, error) {
+	value, err := n.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := value.(undefined); ok {
+		return nil, fmt.Errorf("%s", u)
+	}
+	return value, nil
+}
+
+// Tests used with "is" and "is not".
+var tests = map[string]func(value interface{}) (bool, error){
+	"defined": func(value interface{}) (bool, error) {
+		_, ok := value.(undefined)
+		return !ok, nil
+	},
+	"undefined": func(value interface{}) (bool, error) {
+		_, ok := value.(undefined)
+		return ok, nil
+	},
+	"none": func(value interface{}) (bool, error) {
+		return value == nil, nil
+	},
+	"string": func(value interface{}) (bool, error) {
+		_, ok := value.(string)
+		return ok, nil
+	},
+	"number": func(value interface{}) (bool, error) {
+		_, ok := toFloat(value)
+		_, isBool := value.(bool)
+		return ok && !isBool, nil
+	},
+	"succeeded": resultTest("failed", false),
+	"success":   resultTest("failed", false),
+	"failed":    resultTest("failed", true),
+	"failure":   resultTest("failed", true),
+	"changed":   resultTest("changed", true),
+	"skipped":   resultTest("skipped", true),
+}
+
+// resultTest checks a flag of a registered task result.
+func resultTest(key string, want bool) func(value interface{}) (bool, error) {
+	return func(value interface{}) (bool, error) {
+		result, ok := value.(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("only registered task results can be tested with '%s', not %s", key, typeName(value))
+		}
+		return truthy(result[key]) == want, nil
+	}
+}
+
+// Filters used with "|". default is the only one that accepts an undefined
+// value.
+var filters map[string]func(value interface{}, args []interface{}) (interface{}, error)
+
+func init() {
+	filters = map[string]func(value interface{}, args []interface{}) (interface{}, error){
+		"default": filterDefault,
+		"d":       filterDefault,
+		"bool": func(value interface{}, args []interface{}) (interface{}, error) {
+			if s, ok := value.(string); ok {
+				switch strings.ToLower(strings.TrimSpace(s)) {
+				case "yes", "on", "true", "1", "y":
+					return true, nil
+				}
+				return false, nil
+			}
+			return truthy(value), nil
+		},
+		"int": func(value interface{}, args []interface{}) (interface{}, error) {
+			if s, ok := value.(string); ok {
+				n, err := strconv.Atoi(strings.TrimSpace(s))
+				if err != nil {
+					return 0, nil
+				}
+				return n, nil
+			}
+			f, _ := toFloat(value)
+			return int(f), nil
+		},
+		"float": func(value interface{}, args []interface{}) (interface{}, error) {
+			if s, ok := value.(string); ok {
+				f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+				if err != nil {
+					return 0.0, nil
+				}
+				return f, nil
+			}
+			f, _ := toFloat(value)
+			return f, nil
+		},
+		"string": func(value interface{}, args []interface{}) (interface{}, error) {
+			return toString(value), nil
+		},
+		"length": filterLength,
+		"count":  filterLength,
+		"lower": func(value interface{}, args []interface{}) (interface{}, error) {
+			return strings.ToLower(toString(value)), nil
+		},
+		"upper": func(value interface{}, args []interface{}) (interface{}, error) {
+			return strings.ToUpper(toString(value)), nil
+		},
+		"trim": func(value interface{}, args []interface{}) (interface{}, error) {
+			return strings.TrimSpace(toString(value)), nil
+		},
+		"first": func(value interface{}, args []interface{}) (interface{}, error) {
+			list, ok := value.([]interface{})
+			if !ok || len(list) == 0 {
+				return undefined{"first item"}, nil
+			}
+			return list[0], nil
+		},
+		"last": func(value interface{}, args []interface{}) (interface{}, error) {
+			list, ok := value.([]interface{})
+			if !ok || len(list) == 0 {
+				return undefined{"last item"}, nil
+			}
+			return list[len(list)-1], nil
+		},
+		"join": func(value interface{}, args []interface{}) (interface{}, error) {
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("join expects a list, not %s", typeName(value))
+			}
+			sep := ""
+			if len(args) > 0 {
+				sep = toString(args[0])
+			}
+			parts := make([]string, len(list))
+			for i, item := range list {
+				parts[i] = toString(item)
+			}
+			return strings.Join(parts, sep), nil
+		},
+	}
+}
+
+func filterDefault(value interface{}, args []interface{}) (interface{}, error) {
+	if _, ok := value.(undefined); ok {
+		if len(args) == 0 {
+			return "", nil
+		}
+		return args[0], nil
+	}
+	return value, nil
+}
+
+func filterLength(value interface{}, args []interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return len(v), nil
+	case []interface{}:
+		return len(v), nil
+	case map[string]interface{}:
+		return len(v), nil
+	}
+	return nil, fmt.Errorf("%s has no length", typeName(value))
+}
+
+// Value helpers
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil, undefined:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	if f, ok := toFloat(value); ok {
+		return f != 0
+	}
+	return true
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func toInt(value interface{}) (int, bool) {
+	f, ok := toFloat(value)
+	if !ok || f != math.Trunc(f) {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// toString renders a value the way it appears in templates and output.
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = quoted(item)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			parts[i] = fmt.Sprintf("'%s': %s", key, quoted(v[key]))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	}
+	return fmt.Sprint(value)
+}
+
+func quoted(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return "'" + s + "'"
+	}
+	return toString(value)
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "none"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a dict"
+	}
+	if _, ok := toFloat(value); ok {
+		return "a number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func equal(a, b interface{}) bool {
+	fa, aNum := toFloat(a)
+	fb, bNum := toFloat(b)
+	if aNum && bNum {
+		return fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func compare(a, b interface{}) (int, error) {
+	fa, aNum := toFloat(a)
+	fb, bNum := toFloat(b)
+	if aNum && bNum {
+		switch {
+		case fa < fb:
+			return -1, nil
+		case fa > fb:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	sa, aStr := a.(string)
+	sb, bStr := b.(string)
+	if aStr && bStr {
+		return strings.Compare(sa, sb), nil
+	}
+	return 0, fmt.Errorf("cannot compare %s with %s", typeName(a), typeName(b))
+}
+
+func contained(item, container interface{}) (interface{}, error) {
+	switch c := container.(type) {
+	case string:
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot look for %s in a string", typeName(item))
+		}
+		return strings.Contains(c, s), nil
+	case []interface{}:
+		for _, element := range c {
+			if equal(item, element) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]interface{}:
+		_, ok := c[toString(item)]
+		return ok, nil
+	}
+	return nil, fmt.Errorf("cannot use 'in' with %s", typeName(container))
+}
+
+func arithmetic(op string, a, b interface{}) (interface{}, error) {
+	fa, aNum := toFloat(a)
+	fb, bNum := toFloat(b)
+	if !aNum || !bNum {
+		return nil, fmt.Errorf("cannot use '%s' with %s and %s", op, typeName(a), typeName(b))
+	}
+	ia, aInt := a.(int)
+	ib, bInt := b.(int)
+	bothInt := aInt && bInt
+
+	switch op {
+	case "+":
+		if bothInt {
+			return ia + ib, nil
+		}
+		return fa + fb, nil
+	case "-":
+		if bothInt {
+			return ia - ib, nil
+		}
+		return fa - fb, nil
+	case "*":
+		if bothInt {
+			return ia * ib, nil
+		}
+		return fa * fb, nil
+	case "/":
+		if fb == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return fa / fb, nil
+	case "%":
+		if !bothInt {
+			return nil, fmt.Errorf("'%%' needs whole numbers")
+		}
+		if ib == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return ia % ib, nil
+	}
+	return nil, fmt.Errorf("unknown operator '%s'", op)
+}
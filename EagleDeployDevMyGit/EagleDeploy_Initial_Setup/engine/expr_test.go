@@ -0,0 +1,208 @@
+package engine
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var exprVars = map[string]interface{}{
+	"n":     3,
+	"f":     1.5,
+	"name":  "web",
+	"empty": "",
+	"flag":  true,
+	"none":  nil,
+	"list":  []interface{}{1, 2, 3},
+	"host": map[string]interface{}{
+		"os":    "Debian",
+		"ports": []interface{}{80, 443},
+	},
+	"result": map[string]interface{}{"failed": false, "changed": true, "skipped": false},
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"", "unexpected"},
+		{"1 +", "unexpected"},
+		{"(1 + 2", "expected ')'"},
+		{"[1, 2", "expected ','"},
+		{"'open", "unterminated string starting at position 1"},
+		{"a $ b", "unexpected character '$' at position 3"},
+		{"1.2.3", "invalid number '1.2.3'"},
+		{"1 2", "unexpected"},
+		{"x is", "expected a test name after 'is'"},
+		{"x |", "expected a filter name after '|'"},
+		{"x | nosuchfilter", "unknown filter 'nosuchfilter' at position 5"},
+	}
+	for _, test := range tests {
+		_, err := ParseExpr(test.src)
+		if err == nil {
+			t.Errorf("ParseExpr(%q) succeeded, want an error", test.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("ParseExpr(%q) error = %q, want it to contain %q", test.src, err, test.want)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		// Literals.
+		{"42", 42},
+		{"2.5", 2.5},
+		{"'single'", "single"},
+		{`"double"`, "double"},
+		{"true", true},
+		{"False", false},
+		{"none", nil},
+		{"[1, 'a']", []interface{}{1, "a"}},
+
+		// Precedence: * before +, comparison before not, not before and,
+		// and before or.
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"7 % 4 + 1", 4},
+		{"-n + 5", 2},
+		{"1 + 2 == 3", true},
+		{"not 1 == 2", true},
+		{"not flag and flag", false},
+		{"true or false and false", true},
+		{"(true or false) and false", false},
+		{"n > 2 and n < 4", true},
+
+		// Arithmetic keeps whole numbers whole, except for division.
+		{"n * 2", 6},
+		{"n + f", 4.5},
+		{"n / 2", 1.5},
+
+		// Variables, attributes and indexes.
+		{"name", "web"},
+		{"host.os", "Debian"},
+		{"host['os']", "Debian"},
+		{"host.ports[1]", 443},
+		{"list[-1]", 3},
+
+		// Comparisons and membership.
+		{"host.os == 'Debian'", true},
+		{"name != 'db'", true},
+		{"'a' < 'b'", true},
+		{"2 in list", true},
+		{"5 not in list", true},
+		{"'eb' in name", true},
+		{"'os' in host", true},
+
+		// Tests.
+		{"name is defined", true},
+		{"missing is defined", false},
+		{"missing is undefined", true},
+		{"host.missing is not defined", true},
+		{"none is none", true},
+		{"name is string", true},
+		{"n is number", true},
+		{"flag is number", false},
+		{"result is changed", true},
+		{"result is succeeded", true},
+		{"result is failed", false},
+
+		// Filters, default being the only one that takes undefined values.
+		{"missing | default('x')", "x"},
+		{"missing | d", ""},
+		{"host.missing | default(1) + 1", 2},
+		{"name | default('x')", "web"},
+		{"empty | default('x')", ""},
+		{"name | upper", "WEB"},
+		{"list | length", 3},
+		{"list | join(',')", "1,2,3"},
+		{"list | first", 1},
+		{"'yes' | bool", true},
+		{"'12' | int + 1", 13},
+		{"'  a ' | trim", "a"},
+	}
+	for _, test := range tests {
+		expr, err := ParseExpr(test.src)
+		if err != nil {
+			t.Errorf("ParseExpr(%q): %v", test.src, err)
+			continue
+		}
+		got, err := expr.Eval(exprVars)
+		if err != nil {
+			t.Errorf("Eval(%q): %v", test.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Eval(%q) = %#v, want %#v", test.src, got, test.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"missing", "'missing' is undefined"},
+		{"missing + 1", "'missing' is undefined"},
+		{"host.missing", "is undefined"},
+		{"missing | upper", "'missing' is undefined"},
+		{"1 / 0", "division by zero"},
+		{"n % 0", "division by zero"},
+		{"f % 2", "'%' needs whole numbers"},
+		{"name + 1", "cannot use '+'"},
+		{"name < 1", "cannot compare"},
+		{"1 in n", "cannot use 'in'"},
+		{"name is changed", "only registered task results"},
+		{"n | length", "has no length"},
+	}
+	for _, test := range tests {
+		expr, err := ParseExpr(test.src)
+		if err != nil {
+			t.Errorf("ParseExpr(%q): %v", test.src, err)
+			continue
+		}
+		_, err = expr.Eval(exprVars)
+		if err == nil {
+			t.Errorf("Eval(%q) succeeded, want an error", test.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Eval(%q) error = %q, want it to contain %q", test.src, err, test.want)
+		}
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	tests := []struct {
+		conditions []string
+		want       bool
+	}{
+		{nil, true},
+		{[]string{"host.os == 'Debian'"}, true},
+		{[]string{"host.os == 'Debian'", "n > 5"}, false},
+		{[]string{"empty"}, false},
+		{[]string{"list"}, true},
+		{[]string{"missing | default(false)"}, false},
+	}
+	for _, test := range tests {
+		got, err := EvalCondition(test.conditions, exprVars)
+		if err != nil {
+			t.Errorf("EvalCondition(%q): %v", test.conditions, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("EvalCondition(%q) = %v, want %v", test.conditions, got, test.want)
+		}
+	}
+
+	if _, err := EvalCondition([]string{"missing == 1"}, exprVars); err == nil {
+		t.Error("EvalCondition with an undefined variable succeeded, want an error")
+	}
+}
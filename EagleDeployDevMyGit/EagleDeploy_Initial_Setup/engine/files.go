@@ -0,0 +1,354 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// File modules manage the content of a remote file instead of running a
+// command. They read the file first and only rewrite it when its content
+// has to change, so they can report ok versus changed, describe the change
+// as a diff and take part in check mode without touching the host.
+
+// CopyModule puts a local file, or inline content, at Dest.
+type CopyModule struct {
+	Src     string `yaml:"src"`
+	Content string `yaml:"content"`
+	Dest    string `yaml:"dest"`
+	Mode    string `yaml:"mode"`
+}
+
+// TemplateModule renders the local template Src with the host's variables
+// and puts the result at Dest.
+type TemplateModule struct {
+	Src  string `yaml:"src"`
+	Dest string `yaml:"dest"`
+	Mode string `yaml:"mode"`
+}
+
+// LineInFileModule makes sure Line is in the file at Path, replacing the
+// last line matching Regexp if there is one, or with State "absent" removes
+// every line matching Regexp, or equal to Line without one.
+type LineInFileModule struct {
+	Path   string `yaml:"path"`
+	Line   string `yaml:"line"`
+	Regexp string `yaml:"regexp"`
+	State  string `yaml:"state"`
+	Create bool   `yaml:"create"`
+	Mode   string `yaml:"mode"`
+}
+
+// fileEdit is what a file module wants done to one remote file.
+type fileEdit struct {
+	path string
+	mode string
+	// update returns the file's new content given the current one, and
+	// whether the file has to be written at all.
+	update func(current string, exists bool) (string, bool, error)
+}
+
+// missingFileExit is the exit code readRemoteFile uses for a missing file.
+const missingFileExit = 99
+
+// action returns which of command and the file modules the task uses, or an
+// error if it uses none or several.
+func (t Task) action() (string, error) {
+	var actions []string
+	if t.Command != "" {
+		actions = append(actions, "command")
+	}
+	if t.LocalAction != "" {
+		actions = append(actions, "local_action")
+	}
+	if t.Copy != nil {
+		actions = append(actions, "copy")
+	}
+	if t.Template != nil {
+		actions = append(actions, "template")
+	}
+	if t.LineInFile != nil {
+		actions = append(actions, "lineinfile")
+	}
+	if t.IncludeTasks != "" {
+		actions = append(actions, "include_tasks")
+	}
+	if t.AsyncStatus != nil {
+		actions = append(actions, "async_status")
+	}
+	if t.isBlock() {
+		actions = append(actions, "block")
+	}
+	switch len(actions) {
+	case 0:
+		return "", fmt.Errorf("task '%s' has no command to execute", t.Name)
+	case 1:
+		return actions[0], nil
+	}
+	return "", fmt.Errorf("task '%s' can only have one of %s", t.Name, strings.Join(actions, ", "))
+}
+
+// validateModule checks the arguments of the task's file module, if any.
+func (t Task) validateModule() error {
+	if t.Async < 0 || (t.Poll != nil && *t.Poll < 0) {
+		return fmt.Errorf("task '%s': async and poll cannot be negative", t.Name)
+	}
+	if t.Async > 0 && t.Command == "" && t.LocalAction == "" {
+		return fmt.Errorf("task '%s': async only works with command and local_action", t.Name)
+	}
+	switch {
+	case t.Copy != nil:
+		if t.Copy.Dest == "" || (t.Copy.Src == "") == (t.Copy.Content == "") {
+			return fmt.Errorf("task '%s': copy needs dest and one of src or content", t.Name)
+		}
+	case t.Template != nil:
+		if t.Template.Src == "" || t.Template.Dest == "" {
+			return fmt.Errorf("task '%s': template needs src and dest", t.Name)
+		}
+	case t.LineInFile != nil:
+		m := t.LineInFile
+		if m.Path == "" {
+			return fmt.Errorf("task '%s': lineinfile needs path", t.Name)
+		}
+		switch m.State {
+		case "", "present":
+			if m.Line == "" {
+				return fmt.Errorf("task '%s': lineinfile needs line", t.Name)
+			}
+		case "absent":
+			if m.Line == "" && m.Regexp == "" {
+				return fmt.Errorf("task '%s': lineinfile with state absent needs line or regexp", t.Name)
+			}
+		default:
+			return fmt.Errorf("task '%s': lineinfile state must be present or absent, not '%s'", t.Name, m.State)
+		}
+		if _, err := regexp.Compile(m.Regexp); err != nil {
+			return fmt.Errorf("task '%s': invalid lineinfile regexp: %v", t.Name, err)
+		}
+	case t.AsyncStatus != nil:
+		if t.AsyncStatus.JID == "" {
+			return fmt.Errorf("task '%s': async_status needs jid", t.Name)
+		}
+	}
+	return nil
+}
+
+// localPath resolves a module's src. Tasks of a role look in the role's
+// section directory (files or templates) first, then every task looks in
+// the directory of the file it came from.
+func (t Task) localPath(section, src string) string {
+	if filepath.IsAbs(src) {
+		return src
+	}
+	if t.role != "" {
+		candidate := filepath.Join(t.role, section, src)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return resolvePath(t.dir, src)
+}
+
+// fileEdit renders the task's file module arguments with vars. It returns
+// nil for tasks without a file module.
+func (t Task) fileEdit(vars Vars) (*fileEdit, error) {
+	r := renderer{vars: vars}
+
+	switch {
+	case t.Copy != nil:
+		m := t.Copy
+		content := r.render(m.Content)
+		if m.Src != "" {
+			data, err := ioutil.ReadFile(t.localPath("files", r.render(m.Src)))
+			if err != nil {
+				return nil, fmt.Errorf("unable to read copy source: %v", err)
+			}
+			content = string(data)
+		}
+		return &fileEdit{path: r.render(m.Dest), mode: r.render(m.Mode), update: replaceWith(content)}, r.err
+
+	case t.Template != nil:
+		m := t.Template
+		data, err := ioutil.ReadFile(t.localPath("templates", r.render(m.Src)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read template: %v", err)
+		}
+		content, err := Render(string(data), vars)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render template %s: %v", m.Src, err)
+		}
+		return &fileEdit{path: r.render(m.Dest), mode: r.render(m.Mode), update: replaceWith(content)}, r.err
+
+	case t.LineInFile != nil:
+		m := *t.LineInFile
+		m.Path, m.Line, m.Regexp, m.Mode = r.render(m.Path), r.render(m.Line), r.render(m.Regexp), r.render(m.Mode)
+		if r.err != nil {
+			return nil, r.err
+		}
+		edit, err := m.edit()
+		return edit, err
+	}
+	return nil, nil
+}
+
+// renderer renders several templates and keeps the first error.
+type renderer struct {
+	vars Vars
+	err  error
+}
+
+func (r *renderer) render(text string) string {
+	if r.err != nil {
+		return ""
+	}
+	var out string
+	out, r.err = Render(text, r.vars)
+	return out
+}
+
+func replaceWith(content string) func(string, bool) (string, bool, error) {
+	return func(current string, exists bool) (string, bool, error) {
+		return content, !exists || current != content, nil
+	}
+}
+
+func (m LineInFileModule) edit() (*fileEdit, error) {
+	var re *regexp.Regexp
+	if m.Regexp != "" {
+		var err error
+		if re, err = regexp.Compile(m.Regexp); err != nil {
+			return nil, fmt.Errorf("invalid lineinfile regexp: %v", err)
+		}
+	}
+	matches := func(line string) bool {
+		if re != nil {
+			return re.MatchString(line)
+		}
+		return line == m.Line
+	}
+
+	update := func(current string, exists bool) (string, bool, error) {
+		if !exists && m.State == "absent" {
+			return "", false, nil
+		}
+		if !exists && !m.Create {
+			return "", false, fmt.Errorf("%s does not exist, set create: true to create it", m.Path)
+		}
+
+		lines := splitLines(current)
+		if m.State == "absent" {
+			var kept []string
+			for _, line := range lines {
+				if !matches(line) {
+					kept = append(kept, line)
+				}
+			}
+			if len(kept) == len(lines) {
+				return current, false, nil
+			}
+			return joinLines(kept), true, nil
+		}
+
+		for i := len(lines) - 1; i >= 0; i-- {
+			if matches(lines[i]) {
+				if lines[i] == m.Line {
+					return current, false, nil
+				}
+				lines[i] = m.Line
+				return joinLines(lines), true, nil
+			}
+		}
+		if contains(lines, m.Line) {
+			return current, false, nil
+		}
+		return joinLines(append(lines, m.Line)), true, nil
+	}
+	return &fileEdit{path: m.Path, mode: m.Mode, update: update}, nil
+}
+
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// runFileModule applies the task's file module on a connected host. In check
+// mode the change is worked out and reported but not written.
+func (s *Scheduler) runFileModule(task Task, vars Vars, communicator *Communicator) TaskResult {
+	start := time.Now()
+	result := TaskResult{Task: task.Name, Status: StatusOK}
+	fail := func(err error) TaskResult {
+		result.ExitCode = -1
+		result.Error = err.Error()
+		result.Duration = time.Since(start)
+		return task.failed(result)
+	}
+
+	edit, err := task.fileEdit(vars)
+	if err != nil {
+		return fail(err)
+	}
+	current, exists, err := readRemoteFile(communicator, edit.path)
+	if err != nil {
+		return fail(err)
+	}
+	content, changed, err := edit.update(current, exists)
+	if err != nil {
+		return fail(err)
+	}
+
+	if changed {
+		result.Status = StatusChanged
+		if s.diff {
+			result.Diff = NewFileDiff(edit.path, current, content)
+		}
+		if s.checkMode(task) {
+			result.Message = "check mode"
+		} else if err := writeRemoteFile(communicator, edit.path, content, edit.mode); err != nil {
+			return fail(err)
+		}
+	}
+	result.Duration = time.Since(start)
+	return result
+}
+
+// readRemoteFile returns the content of path on the host and whether it
+// exists.
+func readRemoteFile(communicator *Communicator, path string) (string, bool, error) {
+	quoted := shellQuote(path)
+	cmd := fmt.Sprintf("if [ -e %s ]; then cat -- %s; else exit %d; fi", quoted, quoted, missingFileExit)
+	output, err := communicator.RunCommand(context.Background(), cmd)
+	if output.ExitCode == missingFileExit {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("unable to read %s: %s", path, strings.TrimSpace(output.Stderr))
+	}
+	return output.Stdout, true, nil
+}
+
+// writeRemoteFile replaces the content of path on the host, passing it on
+// standard input, and applies mode if one is given.
+func writeRemoteFile(communicator *Communicator, path, content, mode string) error {
+	quoted := shellQuote(path)
+	cmd := "cat > " + quoted
+	if mode != "" {
+		cmd += " && chmod " + shellQuote(mode) + " " + quoted
+	}
+	output, err := communicator.RunCommandWithInput(context.Background(), cmd, strings.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("unable to write %s: %s", path, strings.TrimSpace(output.Stderr))
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single word for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSH hosts have to prove who they are with a key listed in a known_hosts
+// file, ~/.ssh/known_hosts unless the playbook names another, before any
+// password or command is sent to them. Hosts can be added with ssh-keyscan
+// or by connecting once with ssh. A playbook that sets
+// host_key_checking: false skips the check, which lets anyone who can
+// intercept the connection pose as the host.
+
+// hostKeyCheck returns the host key callback for target and the host key
+// algorithms to ask for, so a host with several keys offers the one that is
+// known.
+func hostKeyCheck(target Target, address string) (ssh.HostKeyCallback, []string, error) {
+	if target.SkipHostKeyCheck {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+	filename := target.KnownHostsFile
+	if filename == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to find the known hosts file: %v", err)
+		}
+		filename = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read known hosts file %s: %v", filename, err)
+	}
+
+	check := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("host key of %s is not in %s; add it with ssh-keyscan or set host_key_checking: false", hostname, filename)
+			}
+			return fmt.Errorf("host key of %s does not match the one in %s", hostname, filename)
+		}
+		return err
+	}
+	return check, knownAlgorithms(callback, address), nil
+}
+
+// knownAlgorithms returns the host key algorithms of the keys known for
+// address, or nil if there are none. The callback lists them when asked to
+// check a key that is not among them.
+func knownAlgorithms(callback ssh.HostKeyCallback, address string) []string {
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(address, &net.TCPAddr{}, probe), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch keyType := known.Key.Type(); keyType {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, keyType)
+		}
+	}
+	return algorithms
+}
+
+// expandHome replaces a leading ~/ in path with the user's home directory.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
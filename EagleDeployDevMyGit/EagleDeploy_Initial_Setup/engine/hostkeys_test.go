@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeyChecking(t *testing.T) {
+	server := startSSHServer(t)
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(other.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		settings string
+		known    ssh.PublicKey
+		want     string
+	}{
+		{"known key", "known_hosts_file: known_hosts", server.key.PublicKey(), ""},
+		{"unknown host", "known_hosts_file: known_hosts", nil, "is not in"},
+		{"changed key", "known_hosts_file: known_hosts", otherKey, "does not match"},
+		{"missing file", "known_hosts_file: missing", nil, "unable to read known hosts file"},
+		{"checking off", "host_key_checking: false", nil, ""},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		if test.known != nil {
+			server.writeKnownHosts(t, dir, test.known)
+		} else if !strings.Contains(test.settings, "missing") {
+			// An entry for another port is not an entry for the server.
+			server.port++
+			server.writeKnownHosts(t, dir, otherKey)
+			server.port--
+		}
+		result, output := runPlaybookIn(t, dir, fmt.Sprintf(`
+name: keys
+hosts: [%s]
+port: %d
+password: secret
+gather_facts: false
+%s
+tasks:
+  - command: "true"
+`, testSSHHost, server.port, test.settings), RunOptions{})
+
+		host := result.Host(testSSHHost)
+		switch {
+		case test.want == "" && host.Failed():
+			t.Errorf("%s: play failed:\n%s", test.name, output)
+		case test.want != "" && (host.Status != StatusUnreachable || !strings.Contains(output, test.want)):
+			t.Errorf("%s: want the host unreachable with %q, got %s:\n%s", test.name, test.want, host.Status, output)
+		}
+	}
+}
+
+func TestKeyFileRelativeToPlaybook(t *testing.T) {
+	server := startSSHServer(t)
+	dir := t.TempDir()
+	server.writeClientKey(t, dir, "deploy_key")
+	server.writeKnownHosts(t, dir, server.key.PublicKey())
+	result, output := runPlaybookIn(t, dir, fmt.Sprintf(`
+name: key
+hosts: [%s]
+port: %d
+private_key_file: deploy_key
+known_hosts_file: known_hosts
+gather_facts: false
+tasks:
+  - command: "true"
+`, testSSHHost, server.port), RunOptions{})
+
+	if result.Host(testSSHHost).Failed() {
+		t.Errorf("play failed:\n%s", output)
+	}
+}
@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Task files are YAML lists of tasks shared between playbooks. They are
+// pulled in two ways: import_tasks splices a file's tasks into the play
+// when the playbook is loaded, so tags and --list-tags see them, while
+// include_tasks loads the file when the task runs on a host, so its path
+// and vars may use that host's variables. Task names, the include's own
+// among them, are not templates and print as written. Either way the path
+// is relative to the file that names it, and a file that ends up including
+// itself is reported together with the chain of files that led there.
+
+// loadTaskFile reads a task file and resolves its own import_tasks.
+func loadTaskFile(filename string, chain []string) ([]Task, error) {
+	chain, err := extendChain(chain, filename)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read task file: %v", err)
+	}
+	var tasks []Task
+	if err := yaml.Unmarshal(data, &tasks); err != nil {
+		return nil, fmt.Errorf("unable to parse task file %s: %v", filename, err)
+	}
+	return expandImports(tasks, filepath.Dir(filename), chain)
+}
+
+// expandImports replaces every import_tasks entry with the tasks of its file
+// and records where each task came from.
+func expandImports(tasks []Task, dir string, chain []string) ([]Task, error) {
+	var result []Task
+	for _, task := range tasks {
+		task.dir = dir
+		task.chain = chain
+		if task.isBlock() {
+			block, err := expandBlock(task, dir, chain)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, block)
+			continue
+		}
+		if task.ImportTasks == "" {
+			result = append(result, task)
+			continue
+		}
+		imported, err := loadTaskFile(resolvePath(dir, task.ImportTasks), chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range imported {
+			result = append(result, inherit(task, child))
+		}
+	}
+	return result, nil
+}
+
+// inherit gives a task imported by parent the parent's when conditions,
+// tags, become settings, environment, chdir and vars, down to the tasks of
+// a block.
+func inherit(parent, child Task) Task {
+	child.When = append(append(StringList{}, parent.When...), child.When...)
+	child.Tags = append(append(StringList{}, parent.Tags...), child.Tags...)
+	if child.Become == nil {
+		child.Become = parent.Become
+	}
+	if child.BecomeUser == "" {
+		child.BecomeUser = parent.BecomeUser
+	}
+	if child.BecomeMethod == "" {
+		child.BecomeMethod = parent.BecomeMethod
+	}
+	child.Environment = mergeEnvironment(parent.Environment, child.Environment)
+	if child.Chdir == "" {
+		child.Chdir = parent.Chdir
+	}
+	child = child.mapBlock(func(task Task) Task { return inherit(parent, task) })
+	return inheritVars(parent, child)
+}
+
+// inheritVars gives child the vars of parent. The child's own vars win.
+func inheritVars(parent, child Task) Task {
+	if len(parent.Vars) > 0 {
+		child = child.mapBlock(func(task Task) Task { return inheritVars(parent, task) })
+		vars := make(Vars, len(parent.Vars)+len(child.Vars))
+		for key, value := range parent.Vars {
+			vars[key] = value
+		}
+		for key, value := range child.Vars {
+			vars[key] = value
+		}
+		child.Vars = vars
+	}
+	return child
+}
+
+// extendChain adds filename to the chain of files being loaded, or reports
+// a cycle if it is already part of it.
+func extendChain(chain []string, filename string) ([]string, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		abs = filepath.Clean(filename)
+	}
+	if contains(chain, abs) {
+		cycle := append(append([]string{}, chain...), abs)
+		return nil, fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return append(chain[:len(chain):len(chain)], abs), nil
+}
+
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// includeTasks runs the tasks of an include_tasks file on host, once per
+// loop item if the include loops. The included tasks see the include's vars
+// and loop item, and the tag selections apply to them as to any other task.
+func (s *Scheduler) includeTasks(host string, task Task, vars Vars, communicator *Communicator) bool {
+	items := []interface{}{nil}
+	if task.Loop != nil {
+		var err error
+		if items, err = loopItems(task.Loop, vars); err != nil {
+			result := task.failed(TaskResult{Task: displayName(task), ExitCode: -1, Error: err.Error()})
+			s.record(host, result)
+			return !result.Failed()
+		}
+	}
+
+	for _, item := range items {
+		parent := task
+		itemVars := vars
+		if task.Loop != nil {
+			loopVar := task.LoopControl.loopVar()
+			parent.Vars = withVar(task.Vars, loopVar, item)
+			itemVars = withVar(vars, loopVar, item)
+		}
+
+		filename, tasks, err := s.loadInclude(parent, itemVars)
+		if err != nil {
+			result := task.failed(TaskResult{Task: displayName(task), ExitCode: -1, Error: err.Error()})
+			s.record(host, result)
+			if result.Failed() {
+				return false
+			}
+			continue
+		}
+		s.mu.Lock()
+		if task.Loop != nil {
+			fmt.Fprintf(s.output, "[%s] included: %s (%s=%s)\n", host, filename, task.LoopControl.loopVar(), toString(item))
+		} else {
+			fmt.Fprintf(s.output, "[%s] included: %s\n", host, filename)
+		}
+		s.mu.Unlock()
+
+		for _, child := range selectTasks(tasks, s.only, s.skip) {
+			if s.isStopped() || !s.runTask(host, inheritVars(parent, child), communicator) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// loadInclude loads the file of an include_tasks task, returning its path.
+func (s *Scheduler) loadInclude(task Task, vars Vars) (string, []Task, error) {
+	name, err := Render(task.IncludeTasks, vars)
+	if err != nil {
+		return "", nil, err
+	}
+	filename := resolvePath(task.dir, name)
+	tasks, err := loadTaskFile(filename, task.chain)
+	if err != nil {
+		return "", nil, err
+	}
+	numberTasks(tasks, task.id+":"+filename)
+	if task.role != "" {
+		setRole(tasks, task.role)
+	}
+	if err := s.playbook.validateTasks(tasks); err != nil {
+		return "", nil, err
+	}
+	return filename, tasks, nil
+}
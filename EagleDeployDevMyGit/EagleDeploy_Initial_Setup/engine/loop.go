@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LoopControl tunes how a looped task names its items.
+type LoopControl struct {
+	// LoopVar replaces "item" as the name of the current item's variable.
+	LoopVar string `yaml:"loop_var"`
+	// Label is a template shown instead of the whole item in output.
+	Label string `yaml:"label"`
+}
+
+func (c LoopControl) loopVar() string {
+	if c.LoopVar == "" {
+		return "item"
+	}
+	return c.LoopVar
+}
+
+// loopItems resolves a task's loop: value to the list of items it runs
+// over. The value may be a list, a dict, or a reference to a variable
+// holding either, written as "{{ packages }}" or just "packages". A dict
+// loops over {key, value} items in key order.
+func loopItems(loop interface{}, vars map[string]interface{}) ([]interface{}, error) {
+	loop = normalize(loop)
+	if s, ok := loop.(string); ok && !strings.Contains(s, "{{") {
+		loop = "{{ " + s + " }}"
+	}
+	value, err := renderValue(loop, vars)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve loop: %v", err)
+	}
+
+	switch v := value.(type) {
+	case []interface{}:
+		return v, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := make([]interface{}, len(keys))
+		for i, key := range keys {
+			items[i] = map[string]interface{}{"key": key, "value": v[key]}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("loop needs a list or a dict, not %s", typeName(value))
+}
+
+// withVar returns a copy of vars with name set to value.
+func withVar(vars Vars, name string, value interface{}) Vars {
+	copied := make(Vars, len(vars)+1)
+	for key, v := range vars {
+		copied[key] = v
+	}
+	copied[name] = value
+	return copied
+}
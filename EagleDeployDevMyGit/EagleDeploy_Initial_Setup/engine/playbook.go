@@ -0,0 +1,479 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultForks is the number of hosts worked on at once when neither the
+// playbook nor the command line sets a limit.
+const DefaultForks = 5
+
+type Task struct {
+	Name string `yaml:"name"`
+	// Command may use {{ }} placeholders for variables.
+	Command string `yaml:"command"`
+
+	// Overrides for settings.retries, settings.delay and settings.timeout.
+	// Delay and Timeout are in seconds; nil means use the playbook value.
+	Retries *int `yaml:"retries"`
+	Delay   *int `yaml:"delay"`
+	Timeout *int `yaml:"timeout"`
+
+	// IgnoreErrors keeps the host in the play when this task fails.
+	IgnoreErrors bool `yaml:"ignore_errors"`
+
+	// Notify names the handlers to run at the end of the play when this
+	// task reports a change on a host.
+	Notify StringList `yaml:"notify"`
+
+	// Meta replaces the command with an instruction to the scheduler. The
+	// only one is "flush_handlers", which runs pending handlers right away.
+	Meta string `yaml:"meta"`
+
+	// When holds conditions that must all be true for the task to run on a
+	// host; otherwise it is skipped there. See Expr for the syntax.
+	When StringList `yaml:"when"`
+
+	// Loop runs the task once per item, with the item in {{ item }}. It may
+	// be a list, a dict or a variable holding one; see loopItems.
+	Loop        interface{} `yaml:"loop"`
+	LoopControl LoopControl `yaml:"loop_control"`
+
+	// Register names a variable that keeps this task's result on each host
+	// for later tasks, e.g. {{ result.stdout_lines[0] }}. See TaskResult.Vars.
+	Register string `yaml:"register"`
+
+	// ChangedWhen and FailedWhen replace the exit code as the judge of how a
+	// command went. Like When, every condition has to be true. They can use
+	// the result under its register: name.
+	ChangedWhen StringList `yaml:"changed_when"`
+	FailedWhen  StringList `yaml:"failed_when"`
+
+	// CheckMode overrides --check for this task: false runs it for real even
+	// in a dry run, true never runs it.
+	CheckMode *bool `yaml:"check_mode"`
+
+	// File modules, used instead of Command. See files.go.
+	Copy       *CopyModule       `yaml:"copy"`
+	Template   *TemplateModule   `yaml:"template"`
+	LineInFile *LineInFileModule `yaml:"lineinfile"`
+
+	// Tags let --tags and --skip-tags pick tasks. See selected for the
+	// special tags.
+	Tags StringList `yaml:"tags"`
+
+	// Vars are set for this task only, on top of the host's variables.
+	Vars Vars `yaml:"vars"`
+
+	// ImportTasks is replaced by the tasks of another file when the
+	// playbook is loaded; IncludeTasks loads its file, which may be a
+	// template, when the task runs. See include.go.
+	ImportTasks  string `yaml:"import_tasks"`
+	IncludeTasks string `yaml:"include_tasks"`
+
+	// Async runs the command detached on the host for at most that many
+	// seconds, checking on it every Poll seconds. With poll: 0 the task
+	// only starts the job; a later async_status task can wait for it with
+	// the ansible_job_id the task registered. See async.go.
+	Async       int                `yaml:"async"`
+	Poll        *int               `yaml:"poll"`
+	AsyncStatus *AsyncStatusModule `yaml:"async_status"`
+
+	// DelegateTo runs the task on another host, and LocalAction is a
+	// command run on the machine the playbook runs from. Either way the
+	// task keeps the variables of the host it is for. RunOnce runs the task
+	// on one host per batch only. See delegate.go.
+	DelegateTo  string `yaml:"delegate_to"`
+	LocalAction string `yaml:"local_action"`
+	RunOnce     bool   `yaml:"run_once"`
+
+	// Become runs the task as BecomeUser, root by default, using
+	// BecomeMethod, sudo or su. Unset fields fall back to the play's.
+	Become       *bool  `yaml:"become"`
+	BecomeUser   string `yaml:"become_user"`
+	BecomeMethod string `yaml:"become_method"`
+
+	// Environment sets variables for the task's commands, on top of the
+	// play's, and Chdir is the directory they run in. Both may use {{ }}
+	// placeholders. See environment.go.
+	Environment map[string]string `yaml:"environment"`
+	Chdir       string            `yaml:"chdir"`
+
+	// Block groups tasks that share when, tags and vars. Rescue runs on a
+	// host when a task in Block fails there, and Always runs after both in
+	// any case. See block.go.
+	Block  []Task `yaml:"block"`
+	Rescue []Task `yaml:"rescue"`
+	Always []Task `yaml:"always"`
+
+	// dir is the directory of the file the task was loaded from, which
+	// relative module sources and includes are looked up in. chain lists
+	// the files that were imported or included to reach the task.
+	dir   string
+	chain []string
+	// role is the directory of the role the task belongs to, if any.
+	role string
+	// id tells tasks apart for run_once; see numberTasks.
+	id string
+}
+
+// MetaFlushHandlers is the meta task that runs notified handlers mid-play.
+const MetaFlushHandlers = "flush_handlers"
+
+// StringList is a YAML value that may be written as a single string or as a
+// list of strings. Other scalars, such as "when: true", are kept as text.
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []interface{}
+	if err := unmarshal(&list); err != nil {
+		var value interface{}
+		if err := unmarshal(&value); err != nil {
+			return err
+		}
+		list = []interface{}{value}
+	}
+
+	*l = nil
+	for _, item := range list {
+		switch item.(type) {
+		case nil:
+		case map[interface{}]interface{}, []interface{}:
+			return fmt.Errorf("expected a string or a list of strings, got %v", item)
+		default:
+			*l = append(*l, fmt.Sprint(item))
+		}
+	}
+	return nil
+}
+
+// Playbook is a single play: the hosts to work on and the tasks to run on
+// them. A playbook file may hold several; see LoadPlays.
+type Playbook struct {
+	Name     string         `yaml:"name"`
+	Version  string         `yaml:"version"`
+	Tasks    []Task         `yaml:"tasks"`
+	Handlers []Task         `yaml:"handlers"`
+	Roles    []RoleRef      `yaml:"roles"`
+	Hosts    []string       `yaml:"hosts"`
+	Settings map[string]int `yaml:"settings"`
+	Strategy string         `yaml:"strategy"`
+
+	// Vars are available to every host, next to its gathered facts and
+	// inventory_hostname. Facts are gathered unless GatherFacts is false.
+	Vars        Vars  `yaml:"vars"`
+	GatherFacts *bool `yaml:"gather_facts"`
+
+	// Failure policy. A host that fails a task drops out of the rest of the
+	// play. AnyErrorsFatal stops every host on the first failure, and the
+	// play stops once more than MaxFailPercentage of the current batch has
+	// failed.
+	AnyErrorsFatal    bool `yaml:"any_errors_fatal"`
+	MaxFailPercentage *int `yaml:"max_fail_percentage"`
+
+	// Rolling deployment: hosts are worked through in batches sized by
+	// Serial. The next batch only starts if the previous one stayed within
+	// MaxFailPercentage, or had no failures at all when it is unset.
+	Serial Serial `yaml:"serial"`
+
+	// ImportPlaybook makes this entry of a play list stand for the plays of
+	// another playbook file.
+	ImportPlaybook string `yaml:"import_playbook"`
+
+	// Connection details shared by every host in the playbook.
+	RemoteUser     string `yaml:"remote_user"`
+	Password       string `yaml:"password"`
+	PrivateKeyFile string `yaml:"private_key_file"`
+	Port           int    `yaml:"port"`
+	Connection     string `yaml:"connection"`
+
+	// Host keys are checked against KnownHostsFile, ~/.ssh/known_hosts by
+	// default, unless HostKeyChecking is false; see hostkeys.go.
+	// PrivateKeyFile and KnownHostsFile are relative to the playbook file.
+	KnownHostsFile  string `yaml:"known_hosts_file"`
+	HostKeyChecking *bool  `yaml:"host_key_checking"`
+
+	// Privilege escalation for every task that does not set its own; see
+	// Task.Become. BecomePassword answers the sudo or su password prompt.
+	Become         bool   `yaml:"become"`
+	BecomeUser     string `yaml:"become_user"`
+	BecomeMethod   string `yaml:"become_method"`
+	BecomePassword string `yaml:"become_password"`
+
+	// Environment is set for every task's commands, for example a proxy or
+	// a longer PATH. Tasks add to it and override it with their own.
+	Environment map[string]string `yaml:"environment"`
+
+	// dir is the directory of the playbook file.
+	dir string
+}
+
+// LoadPlays reads a playbook file. The file holds a list of plays, each
+// with its own hosts, vars, settings and tasks, or a single play written
+// directly at the top level. import_playbook and import_tasks are resolved
+// here, relative to the file that uses them.
+func LoadPlays(filename string) ([]*Playbook, error) {
+	return loadPlays(filename, nil)
+}
+
+func loadPlays(filename string, chain []string) ([]*Playbook, error) {
+	chain, err := extendChain(chain, filename)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file: %v", err)
+	}
+
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("unable to parse YAML: %v", err)
+	}
+	var plays []*Playbook
+	if _, ok := raw.([]interface{}); ok {
+		err = yaml.Unmarshal(data, &plays)
+	} else {
+		var playbook Playbook
+		err = yaml.Unmarshal(data, &playbook)
+		plays = []*Playbook{&playbook}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse YAML: %v", err)
+	}
+	if len(plays) == 0 {
+		return nil, fmt.Errorf("no plays found in %s", filename)
+	}
+
+	dir := filepath.Dir(filename)
+	var result []*Playbook
+	for i, playbook := range plays {
+		if playbook == nil {
+			return nil, fmt.Errorf("empty play in %s", filename)
+		}
+		if playbook.ImportPlaybook != "" {
+			imported, err := loadPlays(resolvePath(dir, playbook.ImportPlaybook), chain)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, imported...)
+			continue
+		}
+
+		playbook.dir = dir
+		if playbook.Tasks, err = expandImports(playbook.Tasks, dir, chain); err != nil {
+			return nil, err
+		}
+		if playbook.Handlers, err = expandImports(playbook.Handlers, dir, chain); err != nil {
+			return nil, err
+		}
+		if err := playbook.loadRoles(dir, chain); err != nil {
+			return nil, err
+		}
+		prefix := fmt.Sprintf("%s:%d", chain[len(chain)-1], i)
+		numberTasks(playbook.Tasks, prefix)
+		numberTasks(playbook.Handlers, prefix+":handlers")
+		result = append(result, playbook)
+	}
+	return result, nil
+}
+
+// LoadPlaybook reads a playbook file that holds a single play.
+func LoadPlaybook(filename string) (*Playbook, error) {
+	plays, err := LoadPlays(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(plays) > 1 {
+		return nil, fmt.Errorf("%s holds %d plays, expected one", filename, len(plays))
+	}
+	return plays[0], nil
+}
+
+// Validate checks the playbook for mistakes that would stop it from running.
+func (p *Playbook) Validate() error {
+	if len(p.Tasks) == 0 {
+		return fmt.Errorf("no tasks found in the playbook")
+	}
+	for _, handler := range p.Handlers {
+		if handler.Name == "" {
+			return fmt.Errorf("every handler needs a name")
+		}
+	}
+	if err := validateBecome(p.BecomeMethod); err != nil {
+		return err
+	}
+	if err := validateEnvironment(p.Environment); err != nil {
+		return err
+	}
+	return p.validateTasks(append(append([]Task{}, p.Tasks...), p.Handlers...))
+}
+
+// validateBecome checks a become_method.
+func validateBecome(method string) error {
+	switch method {
+	case "", BecomeSudo, BecomeSu:
+		return nil
+	}
+	return fmt.Errorf("unknown become_method '%s', expected sudo or su", method)
+}
+
+// validateTasks checks tasks against the playbook, for example that the
+// handlers they notify exist. Tasks from include_tasks are checked with it
+// when they are loaded.
+func (p *Playbook) validateTasks(tasks []Task) error {
+	for _, task := range tasks {
+		switch task.Meta {
+		case "":
+			if _, err := task.action(); err != nil {
+				return err
+			}
+			if err := task.validateModule(); err != nil {
+				return err
+			}
+			if err := p.validateBlock(task); err != nil {
+				return err
+			}
+		case MetaFlushHandlers:
+		default:
+			return fmt.Errorf("task '%s' has unknown meta '%s'", task.Name, task.Meta)
+		}
+		for _, name := range task.Notify {
+			if !p.hasHandler(name) {
+				return fmt.Errorf("task '%s' notifies unknown handler '%s'", task.Name, name)
+			}
+		}
+		if _, err := parseTemplate(task.Command); err != nil {
+			return fmt.Errorf("task '%s' has an invalid command: %v", task.Name, err)
+		}
+		if _, err := parseTemplate(task.LocalAction); err != nil {
+			return fmt.Errorf("task '%s' has an invalid local_action: %v", task.Name, err)
+		}
+		if _, err := parseTemplate(task.DelegateTo); err != nil {
+			return fmt.Errorf("task '%s' has an invalid delegate_to: %v", task.Name, err)
+		}
+		if err := validateBecome(task.BecomeMethod); err != nil {
+			return fmt.Errorf("task '%s': %v", task.Name, err)
+		}
+		if err := validateEnvironment(task.Environment); err != nil {
+			return fmt.Errorf("task '%s': %v", task.Name, err)
+		}
+		if _, err := parseTemplate(task.Chdir); err != nil {
+			return fmt.Errorf("task '%s' has an invalid chdir: %v", task.Name, err)
+		}
+		if task.LocalAction != "" && task.DelegateTo != "" {
+			return fmt.Errorf("task '%s' can only have one of local_action and delegate_to", task.Name)
+		}
+		if _, err := parseTemplate(task.LoopControl.Label); err != nil {
+			return fmt.Errorf("task '%s' has an invalid loop_control label: %v", task.Name, err)
+		}
+		conditions := map[string]StringList{"when": task.When, "changed_when": task.ChangedWhen, "failed_when": task.FailedWhen}
+		for field, list := range conditions {
+			for _, condition := range list {
+				if _, err := ParseExpr(condition); err != nil {
+					return fmt.Errorf("task '%s' has an invalid %s: %v", task.Name, field, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Playbook) hasHandler(name string) bool {
+	for _, handler := range p.Handlers {
+		if handler.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectHosts returns the playbook hosts that are also in targets, keeping
+// playbook order. Without targets every playbook host is selected.
+func (p *Playbook) SelectHosts(targets []string) ([]string, error) {
+	if len(targets) == 0 {
+		return p.Hosts, nil
+	}
+	for i := range targets {
+		targets[i] = strings.TrimSpace(targets[i])
+	}
+
+	var hosts []string
+	for _, host := range p.Hosts {
+		if contains(targets, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no matching hosts found in the playbook for the provided targets")
+	}
+	return hosts, nil
+}
+
+// Target builds the connection details for a single host of the playbook.
+func (p *Playbook) Target(host string) Target {
+	user := p.RemoteUser
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	return Target{
+		Host:             host,
+		Port:             p.Port,
+		User:             user,
+		Password:         p.Password,
+		KeyFile:          p.path(p.PrivateKeyFile),
+		Local:            p.Connection == "local" || host == "localhost" || host == "127.0.0.1",
+		KnownHostsFile:   p.path(p.KnownHostsFile),
+		SkipHostKeyCheck: p.HostKeyChecking != nil && !*p.HostKeyChecking,
+	}
+}
+
+// ShouldGatherFacts reports whether facts are collected before the first task.
+func (p *Playbook) ShouldGatherFacts() bool {
+	return p.GatherFacts == nil || *p.GatherFacts
+}
+
+// Forks returns the concurrency limit for the playbook. A positive override,
+// usually from a --forks flag, wins over settings.forks.
+func (p *Playbook) Forks(override int) int {
+	if override > 0 {
+		return override
+	}
+	if forks := p.Settings["forks"]; forks > 0 {
+		return forks
+	}
+	return DefaultForks
+}
+
+// path resolves a file named in the playbook against its directory.
+func (p *Playbook) path(name string) string {
+	if name == "" {
+		return ""
+	}
+	return resolvePath(p.dir, expandHome(name))
+}
+
+// Connections returns how many host connections may stay open between
+// tasks, from settings.connections. See connections.go.
+func (p *Playbook) Connections() int {
+	if connections := p.Settings["connections"]; connections > 0 {
+		return connections
+	}
+	return DefaultConnections
+}
+
+// Helper function to check if a slice contains a specific element
+func contains(slice []string, item string) bool {
+	for _, v := range slice {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package engine
+
+import "os/exec"
+
+// killProcessGroup is a no-op on Windows; cancellation only kills bash itself.
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,356 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Status is the outcome of a task on a host, or of a host as a whole.
+type Status string
+
+const (
+	StatusOK          Status = "ok"
+	StatusChanged     Status = "changed"
+	StatusFailed      Status = "failed"
+	StatusSkipped     Status = "skipped"
+	StatusUnreachable Status = "unreachable"
+)
+
+// severity orders statuses so a host reports the worst of its tasks.
+var severity = map[Status]int{
+	StatusSkipped:     0,
+	StatusOK:          1,
+	StatusChanged:     2,
+	StatusFailed:      3,
+	StatusUnreachable: 4,
+}
+
+// TaskResult is the outcome of one task on one host.
+type TaskResult struct {
+	Task     string        `json:"task"`
+	Status   Status        `json:"status"`
+	ExitCode int           `json:"exit_code"`
+	Stdout   string        `json:"stdout"`
+	Stderr   string        `json:"stderr"`
+	Error    string        `json:"error,omitempty"`
+	Ignored  bool          `json:"ignored,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+
+	// Message explains a result that is not an error, such as a task
+	// skipped in check mode.
+	Message string `json:"message,omitempty"`
+
+	// Diff shows how a file module changed its file, when diffs were asked
+	// for.
+	Diff *FileDiff `json:"diff,omitempty"`
+
+	// Items holds one result per item of a looped task. The task's own
+	// status is then the worst of them.
+	Items []TaskResult `json:"items,omitempty"`
+
+	// Delegate is the host that ran the task in place of its own.
+	Delegate string `json:"delegate_to,omitempty"`
+
+	// JobID is the async job a task with poll: 0 started.
+	JobID string `json:"job_id,omitempty"`
+
+	// Rescued is set on a failure that a block's rescue tasks recovered
+	// from. It no longer counts against the host.
+	Rescued bool `json:"rescued,omitempty"`
+
+	// item is the loop item this result belongs to, kept for register:.
+	item interface{}
+	// pending is set while the result's async job may still be running.
+	pending bool
+}
+
+// Failed reports whether the task failed in a way that stops its host.
+func (t TaskResult) Failed() bool {
+	return (t.Status == StatusFailed || t.Status == StatusUnreachable) && !t.Ignored
+}
+
+// failed returns result as a failure of task. Every way a task can fail,
+// from a template that does not render to a command that exits non-zero,
+// ends here, so ignore_errors applies to all of them alike.
+func (t Task) failed(result TaskResult) TaskResult {
+	result.Status = StatusFailed
+	result.Ignored = t.IgnoreErrors
+	return result
+}
+
+// failedWith returns the failure of task for err, which kept it from
+// running.
+func (t Task) failedWith(err error) TaskResult {
+	return t.failed(TaskResult{Task: t.Name, ExitCode: -1, Error: err.Error()})
+}
+
+// Vars returns the result the way register: stores it: stdout, stderr, rc,
+// changed, failed and skipped, plus stdout_lines and stderr_lines. Trailing
+// newlines are dropped from the output. A looped task keeps one such map per
+// item in results.
+func (t TaskResult) Vars() map[string]interface{} {
+	vars := map[string]interface{}{
+		"stdout":       strings.TrimRight(t.Stdout, "\n"),
+		"stderr":       strings.TrimRight(t.Stderr, "\n"),
+		"stdout_lines": lines(t.Stdout),
+		"stderr_lines": lines(t.Stderr),
+		"rc":           t.ExitCode,
+		"changed":      t.Status == StatusChanged,
+		"failed":       t.Status == StatusFailed || t.Status == StatusUnreachable,
+		"skipped":      t.Status == StatusSkipped,
+	}
+	if t.Error != "" {
+		vars["msg"] = t.Error
+	}
+	if t.JobID != "" {
+		vars["ansible_job_id"] = t.JobID
+	}
+	if t.pending {
+		vars["finished"] = false
+	}
+	if t.item != nil {
+		vars["item"] = t.item
+	}
+	if t.Items != nil {
+		results := make([]interface{}, len(t.Items))
+		for i, item := range t.Items {
+			results[i] = item.Vars()
+		}
+		vars["results"] = results
+	}
+	return vars
+}
+
+// hostLabel names host in output, with the delegate that ran the task.
+func (t TaskResult) hostLabel(host string) string {
+	if t.Delegate != "" {
+		return host + " -> " + t.Delegate
+	}
+	return host
+}
+
+func lines(output string) []interface{} {
+	output = strings.TrimRight(output, "\n")
+	if output == "" {
+		return []interface{}{}
+	}
+	var list []interface{}
+	for _, line := range strings.Split(output, "\n") {
+		list = append(list, line)
+	}
+	return list
+}
+
+// HostResult collects the task results of one host in the order they ran.
+// Status is the worst task status, or skipped if the host never ran a task.
+type HostResult struct {
+	Host   string       `json:"host"`
+	Status Status       `json:"status"`
+	Tasks  []TaskResult `json:"tasks"`
+}
+
+func (h *HostResult) add(result TaskResult) {
+	h.Tasks = append(h.Tasks, result)
+	status := result.Status
+	if result.Ignored || result.Rescued {
+		status = StatusOK
+	}
+	if severity[status] > severity[h.Status] {
+		h.Status = status
+	}
+}
+
+// Failed reports whether the host failed a task or could not be reached.
+func (h *HostResult) Failed() bool {
+	return h.Status == StatusFailed || h.Status == StatusUnreachable
+}
+
+// rescue marks the failed tasks from index from on as rescued, works out the
+// host's status without them and returns the last one, or nil if there was
+// none.
+func (h *HostResult) rescue(from int) *TaskResult {
+	var last *TaskResult
+	tasks := h.Tasks
+	h.Tasks, h.Status = nil, StatusSkipped
+	for i, task := range tasks {
+		if i >= from && task.Status == StatusFailed && !task.Ignored {
+			task.Rescued = true
+			last = &tasks[i]
+		}
+		h.add(task)
+	}
+	return last
+}
+
+// Count returns how many of the host's tasks ended with status. Failures
+// that were ignored or rescued are only counted by Ignored and Rescued.
+func (h *HostResult) Count(status Status) int {
+	count := 0
+	for _, task := range h.Tasks {
+		if task.Status == status && !task.Ignored && !task.Rescued {
+			count++
+		}
+	}
+	return count
+}
+
+// Rescued returns how many of the host's tasks failed and were rescued.
+func (h *HostResult) Rescued() int {
+	count := 0
+	for _, task := range h.Tasks {
+		if task.Rescued {
+			count++
+		}
+	}
+	return count
+}
+
+// Ignored returns how many of the host's tasks failed with ignore_errors set.
+func (h *HostResult) Ignored() int {
+	count := 0
+	for _, task := range h.Tasks {
+		if task.Ignored {
+			count++
+		}
+	}
+	return count
+}
+
+// RunResult is everything a playbook run produced, host by host. A host's
+// tasks from every play it was in are kept together. Aborted holds the
+// reason when a play or rollout was stopped before the end.
+type RunResult struct {
+	Playbook string        `json:"playbook"`
+	Version  string        `json:"version"`
+	Plays    []string      `json:"plays"`
+	Hosts    []*HostResult `json:"hosts"`
+	Aborted  string        `json:"aborted,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+	// Check is set for dry runs, which changed nothing on the hosts.
+	Check bool `json:"check,omitempty"`
+}
+
+func newRunResult(playbook *Playbook, check bool) *RunResult {
+	return &RunResult{Playbook: playbook.Name, Version: playbook.Version, Check: check}
+}
+
+// addHosts adds a result for every host not seen in an earlier play.
+func (r *RunResult) addHosts(hosts []string) {
+	for _, host := range hosts {
+		if r.Host(host) == nil {
+			r.Hosts = append(r.Hosts, &HostResult{Host: host, Status: StatusSkipped})
+		}
+	}
+}
+
+// Host returns the result for host, or nil if it was not part of the run.
+func (r *RunResult) Host(host string) *HostResult {
+	for _, h := range r.Hosts {
+		if h.Host == host {
+			return h
+		}
+	}
+	return nil
+}
+
+// Failed reports whether any host failed or the rollout was aborted.
+func (r *RunResult) Failed() bool {
+	if r.Aborted != "" {
+		return true
+	}
+	for _, h := range r.Hosts {
+		if h.Failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// TaskDiff is a file diff together with where it came from.
+type TaskDiff struct {
+	Host string    `json:"host"`
+	Task string    `json:"task"`
+	Diff *FileDiff `json:"diff"`
+}
+
+// Diffs lists every file diff of the run, host by host in task order.
+func (r *RunResult) Diffs() []TaskDiff {
+	diffs := []TaskDiff{}
+	for _, h := range r.Hosts {
+		for _, task := range h.Tasks {
+			for _, t := range append([]TaskResult{task}, task.Items...) {
+				if t.Diff != nil {
+					diffs = append(diffs, TaskDiff{Host: h.Host, Task: t.Task, Diff: t.Diff})
+				}
+			}
+		}
+	}
+	return diffs
+}
+
+// Print renders the result as text. The CLIs and the web UI all use it so a
+// run reads the same wherever it was started.
+func (r *RunResult) Print(w io.Writer) {
+	mode := ""
+	if r.Check {
+		mode = " in check mode"
+	}
+	fmt.Fprintf(w, "Results of Playbook: %s (Version: %s)%s\n", r.Playbook, r.Version, mode)
+	if len(r.Plays) > 1 {
+		fmt.Fprintf(w, "Plays: %s\n", strings.Join(r.Plays, ", "))
+	}
+	for _, h := range r.Hosts {
+		for _, task := range h.Tasks {
+			printTask(w, h.Host, task)
+			for _, item := range task.Items {
+				printTask(w, h.Host, item)
+			}
+		}
+	}
+	if r.Aborted != "" {
+		fmt.Fprintf(w, "Aborted: %s\n", r.Aborted)
+	}
+
+	fmt.Fprintln(w, "Host Summary:")
+	for _, h := range r.Hosts {
+		fmt.Fprintf(w, "[%s] %s  ok=%d changed=%d failed=%d skipped=%d unreachable=%d rescued=%d ignored=%d\n",
+			h.Host, h.Status, h.Count(StatusOK), h.Count(StatusChanged), h.Count(StatusFailed),
+			h.Count(StatusSkipped), h.Count(StatusUnreachable), h.Rescued(), h.Ignored())
+	}
+	fmt.Fprintf(w, "Finished in %.2fs\n", r.Duration.Seconds())
+}
+
+func printTask(w io.Writer, host string, task TaskResult) {
+	status := string(task.Status)
+	if task.Ignored {
+		status += " (ignored)"
+	}
+	if task.Rescued {
+		status += " (rescued)"
+	}
+	fmt.Fprintf(w, "[%s] %s: %s (%.2fs)\n", task.hostLabel(host), task.Task, status, task.Duration.Seconds())
+	if task.Error != "" {
+		fmt.Fprintf(w, "    error: %s\n", task.Error)
+	}
+	if task.Message != "" {
+		fmt.Fprintf(w, "    message: %s\n", task.Message)
+	}
+	printOutput(w, "stdout", task.Stdout)
+	printOutput(w, "stderr", task.Stderr)
+	if task.Diff != nil {
+		printOutput(w, "diff", task.Diff.Unified())
+	}
+}
+
+func printOutput(w io.Writer, name, output string) {
+	output = strings.TrimRight(output, "\n")
+	if output == "" {
+		return
+	}
+	fmt.Fprintf(w, "    %s:\n", name)
+	for _, line := range strings.Split(output, "\n") {
+		fmt.Fprintf(w, "      %s\n", line)
+	}
+}
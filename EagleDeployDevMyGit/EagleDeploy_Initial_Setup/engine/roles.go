@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Roles are directories of reusable play content, found next to the
+// playbook as roles/<name>:
+//
+//	tasks/main.yaml      tasks, run before the play's own tasks
+//	handlers/main.yaml   handlers, added to the play's handlers
+//	defaults/main.yaml   variables that anything else may override
+//	vars/main.yaml       variables for the role's own tasks
+//	files/, templates/   sources for copy and template
+//	meta/main.yaml       dependencies: roles to run before this one
+//
+// Every file may also end in .yml. A role runs once per play, however many
+// roles depend on it.
+
+// RoleRef names a role in a play's roles: list or in a role's dependencies.
+// It is either just the name or a map with role and optional vars, when and
+// tags, which apply to every task of the role.
+type RoleRef struct {
+	Role string     `yaml:"role"`
+	Vars Vars       `yaml:"vars"`
+	When StringList `yaml:"when"`
+	Tags StringList `yaml:"tags"`
+}
+
+func (r *RoleRef) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*r = RoleRef{Role: name}
+		return nil
+	}
+	type plain RoleRef
+	return unmarshal((*plain)(r))
+}
+
+type roleMeta struct {
+	Dependencies []RoleRef `yaml:"dependencies"`
+}
+
+// roleLoader collects the content of a play's roles in the order they run.
+type roleLoader struct {
+	dir      string
+	chain    []string
+	loaded   map[string]bool
+	tasks    []Task
+	handlers []Task
+	defaults Vars
+}
+
+// loadRoles adds the tasks, handlers and defaults of the play's roles, and
+// of the roles they depend on, to the play. dir is the playbook's directory.
+func (p *Playbook) loadRoles(dir string, chain []string) error {
+	if len(p.Roles) == 0 {
+		return nil
+	}
+	loader := &roleLoader{dir: dir, chain: chain, loaded: make(map[string]bool), defaults: Vars{}}
+	for _, ref := range p.Roles {
+		if err := loader.load(ref, nil); err != nil {
+			return err
+		}
+	}
+
+	p.Tasks = append(loader.tasks, p.Tasks...)
+	p.Handlers = append(p.Handlers, loader.handlers...)
+	if p.Vars == nil {
+		p.Vars = Vars{}
+	}
+	for key, value := range loader.defaults {
+		if _, ok := p.Vars[key]; !ok {
+			p.Vars[key] = value
+		}
+	}
+	return nil
+}
+
+// load loads one role after its dependencies. stack holds the roles whose
+// dependencies are being loaded, to report dependency cycles.
+func (l *roleLoader) load(ref RoleRef, stack []string) error {
+	if ref.Role == "" {
+		return fmt.Errorf("role without a name")
+	}
+	if contains(stack, ref.Role) {
+		return fmt.Errorf("role dependency cycle: %s -> %s", strings.Join(stack, " -> "), ref.Role)
+	}
+	path := rolePath(l.dir, ref.Role)
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return fmt.Errorf("role '%s' not found at %s", ref.Role, path)
+	}
+	if l.loaded[path] {
+		return nil
+	}
+
+	var meta roleMeta
+	if err := readRoleFile(path, "meta", &meta); err != nil {
+		return err
+	}
+	stack = append(stack[:len(stack):len(stack)], ref.Role)
+	for _, dep := range meta.Dependencies {
+		dep.When = append(append(StringList{}, ref.When...), dep.When...)
+		dep.Tags = append(append(StringList{}, ref.Tags...), dep.Tags...)
+		if err := l.load(dep, stack); err != nil {
+			return err
+		}
+	}
+	l.loaded[path] = true
+
+	var defaults, vars Vars
+	if err := readRoleFile(path, "defaults", &defaults); err != nil {
+		return err
+	}
+	if err := readRoleFile(path, "vars", &vars); err != nil {
+		return err
+	}
+	for key, value := range defaults {
+		if _, ok := l.defaults[key]; !ok {
+			l.defaults[key] = value
+		}
+	}
+	for key, value := range ref.Vars {
+		vars = withVar(vars, key, value)
+	}
+	parent := Task{When: ref.When, Tags: ref.Tags, Vars: vars}
+
+	name := filepath.Base(path)
+	tasks, err := l.loadTasks(path, "tasks")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if task.Name != "" {
+			task.Name = name + " : " + task.Name
+		}
+		l.tasks = append(l.tasks, inherit(parent, task))
+	}
+	handlers, err := l.loadTasks(path, "handlers")
+	if err != nil {
+		return err
+	}
+	for _, handler := range handlers {
+		l.handlers = append(l.handlers, inheritVars(parent, handler))
+	}
+	return nil
+}
+
+// loadTasks loads the tasks or handlers of the role at path, marking them as
+// the role's so copy and template look in its files and templates.
+func (l *roleLoader) loadTasks(path, section string) ([]Task, error) {
+	filename := roleFile(path, section)
+	if filename == "" {
+		return nil, nil
+	}
+	tasks, err := loadTaskFile(filename, l.chain)
+	if err != nil {
+		return nil, err
+	}
+	setRole(tasks, path)
+	return tasks, nil
+}
+
+// setRole marks tasks, down to those in blocks, as belonging to the role at
+// path, unless they already belong to one.
+func setRole(tasks []Task, path string) {
+	for i := range tasks {
+		if tasks[i].role == "" {
+			tasks[i].role = path
+		}
+		for _, section := range tasks[i].sections() {
+			setRole(*section, path)
+		}
+	}
+}
+
+// rolePath finds a role by name under dir/roles, or by path if the name
+// holds a slash.
+func rolePath(dir, name string) string {
+	if strings.ContainsRune(name, '/') {
+		return resolvePath(dir, name)
+	}
+	return filepath.Join(dir, "roles", name)
+}
+
+// roleFile returns the main file of a role section, or "" if there is none.
+func roleFile(path, section string) string {
+	for _, name := range []string{"main.yaml", "main.yml"} {
+		filename := filepath.Join(path, section, name)
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+	}
+	return ""
+}
+
+// readRoleFile parses the main file of a role section into out, leaving it
+// untouched if the role has no such file.
+func readRoleFile(path, section string, out interface{}) error {
+	filename := roleFile(path, section)
+	if filename == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", filename, err)
+	}
+	if err := yaml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("unable to parse %s: %v", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+)
+
+// RunOptions controls a single playbook run.
+type RunOptions struct {
+	// Hosts limits the run to these playbook hosts; empty means all of them.
+	Hosts []string
+	// Forks overrides settings.forks when positive.
+	Forks int
+	// Output receives progress lines while the run is going, including the
+	// output of commands as they print it; nil discards them. ErrorOutput
+	// receives what commands print to stderr, and defaults to Output.
+	Output      io.Writer
+	ErrorOutput io.Writer
+	// OnOutput is called with every line a command prints, for example to
+	// log it or show it in the web UI. Calls come one at a time.
+	OnOutput func(OutputLine)
+	// Check walks the playbook without changing the hosts: commands are
+	// skipped unless the task sets check_mode: false.
+	Check bool
+	// Diff records how file modules change, or would change, each file.
+	Diff bool
+	// Tags and SkipTags select the tasks to run by their tags.
+	Tags     []string
+	SkipTags []string
+	// StartAtTask skips every task before the first one with this name,
+	// which may also be a shell pattern such as "Configure*".
+	StartAtTask string
+	// BecomePassword answers become password prompts in place of the
+	// playbook's become_password, so it need not be stored in the file.
+	BecomePassword string
+	// Step is asked before each task starts. Answering StepContinue runs
+	// that task and every later one without asking again.
+	Step func(task string) StepAnswer
+}
+
+// StepAnswer is the reply to a Step question.
+type StepAnswer int
+
+const (
+	StepYes StepAnswer = iota
+	StepNo
+	StepContinue
+)
+
+// RunPlaybook loads the plays in filename and runs them in order. An error
+// means the run could not start at all; task and host failures are reported
+// in the returned RunResult instead.
+func RunPlaybook(filename string, options RunOptions) (*RunResult, error) {
+	plays, err := LoadPlays(filename)
+	if err != nil {
+		return nil, err
+	}
+	return RunPlays(plays, options)
+}
+
+// Run runs an already loaded play.
+func Run(playbook *Playbook, options RunOptions) (*RunResult, error) {
+	return RunPlays([]*Playbook{playbook}, options)
+}
+
+// RunPlays runs plays one after another into a single result. Hosts that
+// failed in one play sit out the later ones, and a play that was aborted
+// ends the run. With options.Hosts set, plays without any of those hosts
+// are left out.
+func RunPlays(plays []*Playbook, options RunOptions) (*RunResult, error) {
+	hosts := make([][]string, len(plays))
+	for i, play := range plays {
+		if err := play.Validate(); err != nil {
+			return nil, err
+		}
+		selected, err := play.SelectHosts(options.Hosts)
+		if err != nil && len(plays) == 1 {
+			return nil, err
+		}
+		hosts[i] = selected
+	}
+
+	// The task to start at is looked for among the tasks the tag selections
+	// let run, as the scheduler does, so a missing one is reported before
+	// anything runs.
+	first := 0
+	if options.StartAtTask != "" {
+		first = -1
+		for i, play := range plays {
+			tasks := selectTasks(play.Tasks, options.Tags, options.SkipTags)
+			if hosts[i] != nil && first < 0 && hasTask(tasks, options.StartAtTask) {
+				first = i
+			}
+		}
+		if first < 0 {
+			return nil, fmt.Errorf("no task named '%s' to start at", options.StartAtTask)
+		}
+	}
+
+	var result *RunResult
+	for i := first; i < len(plays); i++ {
+		play := plays[i]
+		if hosts[i] == nil {
+			continue
+		}
+		if result == nil {
+			result = newRunResult(play, options.Check)
+		} else if result.Aborted != "" {
+			break
+		}
+
+		if options.Output != nil {
+			mode := ""
+			if options.Check {
+				mode = " in check mode"
+			}
+			fmt.Fprintf(options.Output, "Executing Playbook: %s (Version: %s) on Hosts: %v%s\n", play.Name, play.Version, hosts[i], mode)
+		}
+		playOptions := options
+		if i != first {
+			playOptions.StartAtTask = ""
+		}
+		if _, err := newScheduler(play, hosts[i], playOptions, result).RunTasks(); err != nil {
+			return nil, err
+		}
+	}
+	if result == nil {
+		return nil, fmt.Errorf("no matching hosts found in the playbook for the provided targets")
+	}
+	return result, nil
+}
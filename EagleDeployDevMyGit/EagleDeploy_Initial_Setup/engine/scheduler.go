@@ -0,0 +1,711 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Execution strategies. Every host always runs the tasks in playbook order;
+// the strategy decides whether hosts wait for each other between tasks.
+const (
+	// StrategyLinear runs each task on every host before any host starts
+	// the next task.
+	StrategyLinear = "linear"
+	// StrategyFree lets every host work through the tasks on its own, so
+	// fast hosts can finish long before slow ones.
+	StrategyFree = "free"
+)
+
+// Scheduler runs a playbook's tasks across its hosts. At most forks hosts
+// are worked on at any one time; the rest wait in a queue for a free worker.
+// Connections to hosts are kept for the whole batch; see connections.go.
+// Progress is written to output as tasks finish.
+type Scheduler struct {
+	playbook *Playbook
+	tasks    []Task
+	hosts    []string
+	forks    int
+	output   io.Writer
+	errors   io.Writer
+	onOutput func(OutputLine)
+	only     []string
+	skip     []string
+	check    bool
+	diff     bool
+	startAt  string
+	password string
+
+	stepMu sync.Mutex
+	step   func(task string) StepAnswer
+
+	mu       sync.Mutex
+	result   *RunResult
+	stopped  bool
+	notified map[string]map[string]bool
+	once     map[string]*onceResult
+
+	connections *connections
+
+	// vars holds each host's variables. The outer map is filled in up front;
+	// a host's own map is only touched by the worker running that host.
+	vars map[string]Vars
+}
+
+// NewScheduler prepares a run of playbook on hosts. The forks limit comes
+// from playbook.Forks with options.Forks as the override.
+func NewScheduler(playbook *Playbook, hosts []string, options RunOptions) *Scheduler {
+	return newScheduler(playbook, hosts, options, newRunResult(playbook, options.Check))
+}
+
+// newScheduler is NewScheduler adding to the result of earlier plays.
+func newScheduler(playbook *Playbook, hosts []string, options RunOptions, result *RunResult) *Scheduler {
+	result.addHosts(hosts)
+	result.Plays = append(result.Plays, playbook.Name)
+	forks := playbook.Forks(options.Forks)
+	output := options.Output
+	if output == nil {
+		output = io.Discard
+	}
+	errors := options.ErrorOutput
+	if errors == nil {
+		errors = output
+	}
+	vars := make(map[string]Vars, len(hosts))
+	for _, host := range hosts {
+		vars[host] = Vars{"inventory_hostname": host}
+		for key, value := range playbook.Vars {
+			vars[host][key] = value
+		}
+	}
+	return &Scheduler{
+		playbook: playbook,
+		tasks:    selectTasks(playbook.Tasks, options.Tags, options.SkipTags),
+		hosts:    hosts,
+		forks:    forks,
+		output:   output,
+		errors:   errors,
+		onOutput: options.OnOutput,
+		only:     options.Tags,
+		skip:     options.SkipTags,
+		check:    options.Check,
+		diff:     options.Diff,
+		startAt:  options.StartAtTask,
+		password: options.BecomePassword,
+		step:     options.Step,
+		result:   result,
+		notified: make(map[string]map[string]bool),
+		once:     make(map[string]*onceResult),
+		vars:     vars,
+
+		connections: newConnections(playbook.Connections()),
+	}
+}
+
+func (s *Scheduler) RunTasks() (*RunResult, error) {
+	start := time.Now()
+
+	var run func(hosts []string)
+	switch s.playbook.Strategy {
+	case "", StrategyLinear:
+		run = s.runLinear
+	case StrategyFree:
+		run = s.runFree
+	default:
+		return nil, fmt.Errorf("unknown strategy '%s'", s.playbook.Strategy)
+	}
+
+	if s.startAt != "" {
+		tasks, err := startAtTask(s.tasks, s.startAt)
+		if err != nil {
+			return nil, err
+		}
+		s.tasks = tasks
+	}
+
+	// Hosts that failed in an earlier play sit this one out, so they neither
+	// run nor count against a batch here.
+	batches, err := s.playbook.Serial.Batches(s.activeHosts(s.hosts))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, batch := range batches {
+		if len(batches) > 1 {
+			fmt.Fprintf(s.output, "Running batch %d/%d on Hosts: %v\n", i+1, len(batches), batch)
+		}
+		s.resetOnce()
+		run(batch)
+		s.connections.closeAll()
+		if s.stopped {
+			break
+		}
+
+		if failed := s.countFailed(batch); s.tooManyFailed(failed, len(batch)) {
+			if i < len(batches)-1 {
+				s.stop(fmt.Sprintf("%d of %d hosts failed in batch %d", failed, len(batch), i+1))
+			}
+			break
+		}
+	}
+
+	s.result.Duration += time.Since(start)
+	return s.result, nil
+}
+
+func (s *Scheduler) countFailed(hosts []string) int {
+	count := 0
+	for _, host := range hosts {
+		if s.result.Host(host).Failed() {
+			count++
+		}
+	}
+	return count
+}
+
+// tooManyFailed reports whether a batch with failed of total hosts failing
+// should stop the rollout.
+func (s *Scheduler) tooManyFailed(failed, total int) bool {
+	if s.playbook.MaxFailPercentage == nil {
+		return failed > 0
+	}
+	return failed*100 > *s.playbook.MaxFailPercentage*total
+}
+
+// checkMaxFail stops the play as soon as more of batch has failed than
+// max_fail_percentage allows. Without the setting failed hosts just drop out.
+func (s *Scheduler) checkMaxFail(batch []string) {
+	if s.playbook.MaxFailPercentage == nil {
+		return
+	}
+	s.mu.Lock()
+	failed := s.countFailed(batch)
+	s.mu.Unlock()
+	if s.tooManyFailed(failed, len(batch)) {
+		s.stop(fmt.Sprintf("%d of %d hosts failed, more than max_fail_percentage %d%%",
+			failed, len(batch), *s.playbook.MaxFailPercentage))
+	}
+}
+
+// stop ends the play for every host. Tasks already running finish, but no
+// host starts another one. Only the first reason is kept.
+func (s *Scheduler) stop(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopLocked(reason)
+}
+
+func (s *Scheduler) stopLocked(reason string) {
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	s.result.Aborted = reason
+	fmt.Fprintf(s.output, "Aborting play: %s\n", reason)
+}
+
+func (s *Scheduler) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// runLinear keeps hosts in lockstep: a task has finished everywhere before
+// the next one starts.
+func (s *Scheduler) runLinear(hosts []string) {
+	if s.playbook.ShouldGatherFacts() {
+		fmt.Fprintf(s.output, "Executing Task: %s\n", gatherFactsTask)
+		s.forEachHost(hosts, func(_ int, host string) {
+			s.withConnection(host, Task{Name: gatherFactsTask}, func(communicator *Communicator) {
+				s.gatherFacts(host, communicator)
+			})
+		})
+		s.checkMaxFail(hosts)
+		if s.stopped {
+			return
+		}
+	}
+
+	for _, task := range s.tasks {
+		active := s.activeHosts(hosts)
+		if len(active) == 0 {
+			return
+		}
+
+		name := displayName(task)
+		if !s.confirm(name) {
+			continue
+		}
+		fmt.Fprintf(s.output, "Executing Task: %s\n", name)
+		s.forEachHost(active, func(_ int, host string) {
+			s.withConnection(host, task, func(communicator *Communicator) {
+				s.runTask(host, task, communicator)
+			})
+		})
+
+		s.checkMaxFail(hosts)
+		if s.stopped {
+			return
+		}
+	}
+
+	var notified []string
+	for _, host := range s.activeHosts(hosts) {
+		if len(s.notified[host]) > 0 {
+			notified = append(notified, host)
+		}
+	}
+	if len(notified) > 0 {
+		fmt.Fprintln(s.output, "Running Handlers")
+		s.forEachHost(notified, func(_ int, host string) {
+			s.withConnection(host, Task{Name: "Handlers"}, func(communicator *Communicator) {
+				s.flushHandlers(host, communicator)
+			})
+		})
+	}
+}
+
+// runFree gives each worker a whole host: it gathers facts,
+// runs every task and then the notified handlers in order, and only then
+// picks up the next queued host.
+func (s *Scheduler) runFree(hosts []string) {
+	s.forEachHost(s.activeHosts(hosts), func(_ int, host string) {
+		// Hosts still queued when the play stops are left alone.
+		if s.isStopped() {
+			return
+		}
+		s.withConnection(host, Task{Name: "Connect"}, func(communicator *Communicator) {
+			if s.playbook.ShouldGatherFacts() && !s.gatherFacts(host, communicator) {
+				return
+			}
+			for _, task := range s.tasks {
+				if s.isStopped() {
+					return
+				}
+				if !s.confirm(fmt.Sprintf("%s (%s)", displayName(task), host)) {
+					continue
+				}
+				if !s.runTask(host, task, communicator) {
+					return
+				}
+			}
+			s.flushHandlers(host, communicator)
+		})
+		s.checkMaxFail(hosts)
+	})
+}
+
+// confirm asks the Step function whether to run a task. Questions from
+// several workers are asked one at a time.
+func (s *Scheduler) confirm(name string) bool {
+	s.stepMu.Lock()
+	defer s.stepMu.Unlock()
+	if s.step == nil {
+		return true
+	}
+	switch s.step(name) {
+	case StepNo:
+		return false
+	case StepContinue:
+		s.step = nil
+	}
+	return true
+}
+
+func displayName(task Task) string {
+	switch {
+	case task.Name != "":
+		return task.Name
+	case task.Meta != "":
+		return "meta: " + task.Meta
+	case task.IncludeTasks != "":
+		return "include_tasks: " + task.IncludeTasks
+	case task.isBlock():
+		return "block"
+	}
+	return task.Name
+}
+
+// taskVars returns the host's variables with the task's own vars on top.
+// Task vars may be templates over the host's variables.
+func taskVars(hostVars Vars, task Task) (Vars, error) {
+	if len(task.Vars) == 0 {
+		return hostVars, nil
+	}
+	vars := make(Vars, len(hostVars)+len(task.Vars))
+	for key, value := range hostVars {
+		vars[key] = value
+	}
+	for key, value := range task.Vars {
+		rendered, err := renderValue(value, hostVars)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render var '%s': %v", key, err)
+		}
+		vars[key] = rendered
+	}
+	return vars, nil
+}
+
+// startAtTask drops the tasks before the first one whose name matches
+// pattern.
+func startAtTask(tasks []Task, pattern string) ([]Task, error) {
+	for i, task := range tasks {
+		if taskMatches(task, pattern) {
+			return tasks[i:], nil
+		}
+	}
+	return nil, fmt.Errorf("no task named '%s' to start at", pattern)
+}
+
+func hasTask(tasks []Task, pattern string) bool {
+	for _, task := range tasks {
+		if taskMatches(task, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func taskMatches(task Task, pattern string) bool {
+	matched, _ := filepath.Match(pattern, task.Name)
+	return matched || task.Name == pattern
+}
+
+// activeHosts returns the hosts that have not dropped out of the play.
+func (s *Scheduler) activeHosts(hosts []string) []string {
+	var active []string
+	for _, host := range hosts {
+		if !s.result.Host(host).Failed() {
+			active = append(active, host)
+		}
+	}
+	return active
+}
+
+// forEachHost calls fn for every host using a fixed pool of s.forks workers
+// and returns once all calls have finished.
+func (s *Scheduler) forEachHost(hosts []string, fn func(i int, host string)) {
+	queue := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < s.forks && w < len(hosts); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				fn(i, hosts[i])
+			}
+		}()
+	}
+	for i := range hosts {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// withConnection calls fn with the batch's connection to host, connecting
+// first if there is none; see connections.go. If the host cannot be
+// reached, task is recorded as unreachable instead.
+func (s *Scheduler) withConnection(host string, task Task, fn func(communicator *Communicator)) {
+	communicator, release, err := s.connections.get(s.playbook.Target(host))
+	if err != nil {
+		s.record(host, unreachable(task, err))
+		return
+	}
+	defer release()
+	fn(communicator)
+}
+
+// runTask runs task on a connected host and reports whether the host is
+// still in the play afterwards.
+func (s *Scheduler) runTask(host string, task Task, communicator *Communicator) bool {
+	if task.RunOnce {
+		once, first := s.claimOnce(host, task)
+		if !first {
+			<-once.done
+			if task.Register != "" && once.vars != nil {
+				s.vars[host][task.Register] = once.vars
+			}
+			s.record(host, TaskResult{Task: displayName(task), Status: StatusSkipped, Message: "run once on " + once.host})
+			return true
+		}
+		defer close(once.done)
+		if task.Register != "" {
+			defer func() { once.vars, _ = s.vars[host][task.Register].(map[string]interface{}) }()
+		}
+	}
+	if task.isBlock() {
+		return s.runBlock(host, task, communicator)
+	}
+	vars, err := taskVars(s.vars[host], task)
+	if err != nil {
+		result := task.failed(TaskResult{Task: displayName(task), ExitCode: -1, Error: err.Error()})
+		s.record(host, result)
+		return !result.Failed()
+	}
+	if task.Meta == MetaFlushHandlers {
+		if skipped := checkWhen(task, vars); skipped != nil {
+			s.record(host, *skipped)
+			return !skipped.Failed()
+		}
+		return s.flushHandlers(host, communicator)
+	}
+	if task.IncludeTasks != "" {
+		if skipped := checkWhen(task, vars); skipped != nil {
+			s.record(host, *skipped)
+			return !skipped.Failed()
+		}
+		return s.includeTasks(host, task, vars, communicator)
+	}
+
+	var result TaskResult
+	if task.Loop == nil {
+		result = s.execute(host, task, vars, communicator)
+	} else {
+		result = s.executeLoop(host, task, vars, communicator)
+	}
+	if task.Register != "" {
+		s.vars[host][task.Register] = result.Vars()
+	}
+	s.record(host, result)
+	if result.Status == StatusChanged {
+		s.notify(host, task.Notify)
+	}
+	return !result.Failed()
+}
+
+// execute runs a single task, or a single item of a looped task, with vars.
+func (s *Scheduler) execute(host string, task Task, vars Vars, communicator *Communicator) TaskResult {
+	if skipped := checkWhen(task, vars); skipped != nil {
+		return *skipped
+	}
+	delegate, delegated, release, err := s.connectDelegate(task, vars, communicator)
+	if err != nil {
+		return task.failedWith(err)
+	}
+	defer release()
+	result := s.executeOn(host, task, vars, delegated)
+	result.Delegate = delegate
+	return result
+}
+
+// executeOn runs task for host on a connected host, which may be a
+// delegate.
+func (s *Scheduler) executeOn(host string, task Task, vars Vars, communicator *Communicator) TaskResult {
+	environment, dir, err := s.environment(task, vars)
+	if err != nil {
+		return task.failedWith(err)
+	}
+	communicator = communicator.WithEnvironment(environment, dir).WithBecome(s.become(task))
+	action, err := task.action()
+	if err != nil {
+		return task.failedWith(err)
+	}
+	switch action {
+	case "command", "local_action":
+		text := task.Command
+		if action == "local_action" {
+			text = task.LocalAction
+		}
+		command, err := Render(text, vars)
+		if err != nil {
+			return task.failedWith(err)
+		}
+		task.Command = command
+	case "async_status":
+		// The job was not started in check mode, so there is no id to use.
+		if s.checkMode(task) {
+			return TaskResult{Task: task.Name, Status: StatusSkipped, Message: "check mode"}
+		}
+		jid, err := Render(task.AsyncStatus.JID, vars)
+		if err != nil {
+			return task.failedWith(err)
+		}
+		task.AsyncStatus = &AsyncStatusModule{JID: jid}
+	default:
+		return s.runFileModule(task, vars, communicator)
+	}
+	if s.checkMode(task) {
+		return TaskResult{Task: task.Name, Status: StatusSkipped, Message: "check mode"}
+	}
+	communicator = communicator.WithStreaming(s.streamer(host, task.Name))
+	return NewExecutor(task, s.playbook.Settings, vars, communicator, s.notice(host, task.Name)).Execute()
+}
+
+// become returns how task switches user, or nil if it runs as the login
+// user. The task's settings win over the play's.
+func (s *Scheduler) become(task Task) *Become {
+	enabled := s.playbook.Become
+	if task.Become != nil {
+		enabled = *task.Become
+	}
+	if !enabled {
+		return nil
+	}
+	become := &Become{Method: s.playbook.BecomeMethod, User: s.playbook.BecomeUser, Password: s.playbook.BecomePassword}
+	if task.BecomeMethod != "" {
+		become.Method = task.BecomeMethod
+	}
+	if task.BecomeUser != "" {
+		become.User = task.BecomeUser
+	}
+	if s.password != "" {
+		become.Password = s.password
+	}
+	return become
+}
+
+// checkMode reports whether task runs as a dry run. The task's check_mode
+// wins over the run's --check.
+func (s *Scheduler) checkMode(task Task) bool {
+	if task.CheckMode != nil {
+		return *task.CheckMode
+	}
+	return s.check
+}
+
+// executeLoop runs task once per loop item, even after an item fails, and
+// folds the item results into one: failed if any item failed, else changed
+// if any changed, else ok, or skipped when every item was skipped.
+func (s *Scheduler) executeLoop(host string, task Task, vars Vars, communicator *Communicator) TaskResult {
+	result := TaskResult{Task: task.Name, Status: StatusSkipped, Items: []TaskResult{}}
+	items, err := loopItems(task.Loop, vars)
+	if err != nil {
+		return task.failedWith(err)
+	}
+
+	loopVar := task.LoopControl.loopVar()
+	for _, item := range items {
+		itemVars := withVar(vars, loopVar, item)
+		label := toString(item)
+		if task.LoopControl.Label != "" {
+			if label, err = Render(task.LoopControl.Label, itemVars); err != nil {
+				label = task.LoopControl.Label
+			}
+		}
+
+		itemTask := task
+		itemTask.Name = fmt.Sprintf("%s (%s=%s)", task.Name, loopVar, label)
+		itemResult := s.execute(host, itemTask, itemVars, communicator)
+		itemResult.item = item
+		result.Items = append(result.Items, itemResult)
+		result.Duration += itemResult.Duration
+
+		if severity[itemResult.Status] > severity[result.Status] {
+			result.Status = itemResult.Status
+		}
+		if itemResult.Status == StatusFailed {
+			result.ExitCode = itemResult.ExitCode
+			result.Error = "one or more items failed"
+			result.Ignored = itemResult.Ignored
+		}
+	}
+	return result
+}
+
+// checkWhen evaluates the task's when: conditions. It returns nil if the task
+// should run, or the result to record instead: skipped, or failed if a
+// condition could not be evaluated.
+func checkWhen(task Task, vars Vars) *TaskResult {
+	if len(task.When) == 0 {
+		return nil
+	}
+	ok, err := EvalCondition(task.When, vars)
+	if err != nil {
+		result := task.failedWith(err)
+		return &result
+	}
+	if !ok {
+		return &TaskResult{Task: task.Name, Status: StatusSkipped}
+	}
+	return nil
+}
+
+const gatherFactsTask = "Gathering Facts"
+
+// gatherFacts adds host's facts to its variables and reports whether the
+// host is still in the play.
+func (s *Scheduler) gatherFacts(host string, communicator *Communicator) bool {
+	start := time.Now()
+	facts, err := gatherFacts(communicator)
+	if err != nil {
+		s.record(host, TaskResult{Task: gatherFactsTask, Status: StatusFailed, ExitCode: -1, Error: err.Error()})
+		return false
+	}
+	for key, value := range facts {
+		s.vars[host][key] = value
+	}
+	s.record(host, TaskResult{Task: gatherFactsTask, Status: StatusOK, Duration: time.Since(start)})
+	return true
+}
+
+// flushHandlers runs the handlers host has been notified about, each once,
+// in the order the playbook lists them.
+func (s *Scheduler) flushHandlers(host string, communicator *Communicator) bool {
+	for _, handler := range s.playbook.Handlers {
+		s.mu.Lock()
+		pending := s.notified[host][handler.Name]
+		delete(s.notified[host], handler.Name)
+		s.mu.Unlock()
+
+		if pending && !s.runTask(host, handler, communicator) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Scheduler) notify(host string, handlers []string) {
+	if len(handlers) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.notified[host] == nil {
+		s.notified[host] = make(map[string]bool)
+	}
+	for _, name := range handlers {
+		s.notified[host][name] = true
+	}
+}
+
+// record adds a task result to its host and prints a progress line. It is
+// safe to call from several workers at once.
+func (s *Scheduler) record(host string, result TaskResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.result.Host(host).add(result)
+	for _, item := range result.Items {
+		s.printProgress(host, item)
+	}
+	s.printProgress(host, result)
+
+	if result.Failed() && s.playbook.AnyErrorsFatal {
+		s.stopLocked(fmt.Sprintf("task '%s' failed on %s and any_errors_fatal is set", result.Task, host))
+	}
+}
+
+func (s *Scheduler) printProgress(host string, result TaskResult) {
+	host = result.hostLabel(host)
+	switch {
+	case result.Ignored:
+		fmt.Fprintf(s.output, "[%s] %s: %s (ignored): %s\n", host, result.Task, result.Status, result.Error)
+	case result.Error != "":
+		fmt.Fprintf(s.output, "[%s] %s: %s: %s\n", host, result.Task, result.Status, result.Error)
+	case result.Message != "":
+		fmt.Fprintf(s.output, "[%s] %s: %s (%s)\n", host, result.Task, result.Status, result.Message)
+	default:
+		fmt.Fprintf(s.output, "[%s] %s: %s\n", host, result.Task, result.Status)
+	}
+	if result.Diff != nil {
+		fmt.Fprint(s.output, result.Diff.Unified())
+	}
+}
+
+func unreachable(task Task, err error) TaskResult {
+	return TaskResult{Task: task.Name, Status: StatusUnreachable, ExitCode: -1, Error: err.Error()}
+}
@@ -0,0 +1,394 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// runPlaybook writes playbook to a file and runs it. Most tests use
+// connection: local, so every task runs on this machine.
+func runPlaybook(t *testing.T, playbook string, options RunOptions) (*RunResult, string) {
+	t.Helper()
+	return runPlaybookIn(t, t.TempDir(), playbook, options)
+}
+
+// runPlaybookIn is runPlaybook with the playbook file written to dir.
+func runPlaybookIn(t *testing.T, dir, playbook string, options RunOptions) (*RunResult, string) {
+	t.Helper()
+	filename := filepath.Join(dir, "playbook.yaml")
+	if err := ioutil.WriteFile(filename, []byte(playbook), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	if options.Output == nil {
+		options.Output = &output
+	}
+	result, err := RunPlaybook(filename, options)
+	if err != nil {
+		t.Fatalf("RunPlaybook: %v", err)
+	}
+	return result, output.String()
+}
+
+func TestRetryNotices(t *testing.T) {
+	var mu sync.Mutex
+	var notices []OutputLine
+	_, output := runPlaybook(t, `
+name: retry
+hosts: [h1, h2, h3]
+connection: local
+gather_facts: false
+settings:
+  retries: 2
+  delay: 0
+tasks:
+  - name: fail
+    command: "false"
+`, RunOptions{OnOutput: func(line OutputLine) {
+		mu.Lock()
+		defer mu.Unlock()
+		if line.Stream == StreamNotice {
+			notices = append(notices, line)
+		}
+	}})
+
+	if got := strings.Count(output, "retrying"); got != 6 {
+		t.Errorf("output has %d retry notices, want 6:\n%s", got, output)
+	}
+	if len(notices) != 6 {
+		t.Fatalf("OnOutput got %d retry notices, want 6", len(notices))
+	}
+	if notices[0].Task != "fail" || !strings.Contains(notices[0].Text, "retrying") {
+		t.Errorf("notice = %+v, want a retry of task fail", notices[0])
+	}
+}
+
+func TestFreeStopLeavesQueuedHosts(t *testing.T) {
+	result, _ := runPlaybook(t, `
+name: free
+hosts: [h1, h2, h3, h4]
+connection: local
+strategy: free
+any_errors_fatal: true
+settings:
+  forks: 1
+tasks:
+  - name: fail
+    command: "false"
+`, RunOptions{})
+
+	if result.Aborted == "" {
+		t.Fatal("play was not aborted")
+	}
+	for _, host := range []string{"h2", "h3", "h4"} {
+		if tasks := result.Host(host).Tasks; len(tasks) > 0 {
+			t.Errorf("%s ran %d tasks after the play stopped, want none", host, len(tasks))
+		}
+	}
+}
+
+func TestConnectionReusedForBatch(t *testing.T) {
+	server := startSSHServer(t)
+	dir := t.TempDir()
+	server.writeKnownHosts(t, dir, server.key.PublicKey())
+	result, output := runPlaybookIn(t, dir, fmt.Sprintf(`
+name: reuse
+hosts: [%s]
+port: %d
+password: secret
+known_hosts_file: known_hosts
+tasks:
+  - name: first
+    command: echo one
+    notify: restart
+  - name: loop
+    command: echo {{ item }}
+    loop: [a, b, c]
+  - name: delegated
+    command: echo delegated
+    delegate_to: %s
+    loop: [a, b]
+handlers:
+  - name: restart
+    command: echo restart
+`, testSSHHost, server.port, testSSHHost), RunOptions{})
+
+	if host := result.Host(testSSHHost); host.Failed() {
+		t.Fatalf("play failed:\n%s", output)
+	}
+	if got := server.connectionCount(); got != 1 {
+		t.Errorf("%d connections were made, want 1", got)
+	}
+}
+
+func TestIgnoreErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		task string
+	}{
+		{"command", `command: "false"`},
+		{"render", `command: "echo {{ missing }}"`},
+		{"when", "command: \"true\"\n    when: missing == 1"},
+		{"loop", "command: \"echo {{ item }}\"\n    loop: \"{{ missing }}\""},
+		{"environment", "command: \"true\"\n    environment:\n      NAME: \"{{ missing }}\""},
+		{"include", `include_tasks: missing.yaml`},
+		{"file module", `copy: {dest: /nonexistent/dir/file, content: x}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, output := runPlaybook(t, `
+name: ignore
+hosts: [h1]
+connection: local
+gather_facts: false
+tasks:
+  - name: broken
+    ignore_errors: true
+    `+test.task+`
+  - name: after
+    command: "true"
+`, RunOptions{})
+
+			host := result.Host("h1")
+			if host.Failed() || len(host.Tasks) != 2 {
+				t.Fatalf("host failed or stopped early:\n%s", output)
+			}
+			if broken := host.Tasks[0]; broken.Status != StatusFailed || !broken.Ignored {
+				t.Errorf("broken = %s, ignored %v; want an ignored failure", broken.Status, broken.Ignored)
+			}
+		})
+	}
+}
+
+// outcomes returns the name and status of every task host ran, in order.
+func outcomes(result *RunResult, host string) []string {
+	var outcomes []string
+	for _, task := range result.Host(host).Tasks {
+		outcomes = append(outcomes, fmt.Sprintf("%s=%s", task.Task, task.Status))
+	}
+	return outcomes
+}
+
+func TestRescueClearsFailure(t *testing.T) {
+	result, output := runPlaybook(t, `
+name: rescue
+hosts: [h1]
+connection: local
+gather_facts: false
+tasks:
+  - block:
+      - name: break
+        command: "false"
+      - name: not reached
+        command: "true"
+    rescue:
+      - name: recover
+        command: echo {{ ansible_failed_task.name }}
+        register: recovered
+  - name: after
+    command: echo {{ recovered.stdout }}
+`, RunOptions{})
+
+	host := result.Host("h1")
+	if host.Failed() {
+		t.Fatalf("host failed although the block was rescued:\n%s", output)
+	}
+	want := []string{"break=failed", "recover=changed", "after=changed"}
+	if got := outcomes(result, "h1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("tasks = %v, want %v", got, want)
+	}
+	if !host.Tasks[0].Rescued || host.Rescued() != 1 {
+		t.Errorf("failure was not marked rescued")
+	}
+	if after := host.Tasks[2]; strings.TrimSpace(after.Stdout) != "break" {
+		t.Errorf("after printed %q, want the failed task's name", after.Stdout)
+	}
+}
+
+func TestAlwaysRunsAfterFailure(t *testing.T) {
+	result, output := runPlaybook(t, `
+name: always
+hosts: [h1]
+connection: local
+gather_facts: false
+tasks:
+  - block:
+      - name: break
+        command: "false"
+    always:
+      - name: cleanup
+        command: "true"
+  - name: not reached
+    command: "true"
+`, RunOptions{})
+
+	if !result.Host("h1").Failed() {
+		t.Fatalf("host did not fail without a rescue:\n%s", output)
+	}
+	want := []string{"break=failed", "cleanup=changed"}
+	if got := outcomes(result, "h1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("tasks = %v, want %v", got, want)
+	}
+}
+
+func TestHandlersRunOnceAfterChange(t *testing.T) {
+	result, output := runPlaybook(t, `
+name: handlers
+hosts: [h1]
+connection: local
+gather_facts: false
+tasks:
+  - name: change
+    command: "true"
+    notify: restart
+  - name: change again
+    command: "true"
+    notify: restart
+  - name: no change
+    command: "true"
+    changed_when: false
+    notify: reload
+handlers:
+  - name: reload
+    command: "true"
+  - name: restart
+    command: "true"
+`, RunOptions{})
+
+	if result.Host("h1").Failed() {
+		t.Fatalf("play failed:\n%s", output)
+	}
+	want := []string{"change=changed", "change again=changed", "no change=ok", "restart=changed"}
+	if got := outcomes(result, "h1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("tasks = %v, want %v", got, want)
+	}
+}
+
+func TestFlushHandlers(t *testing.T) {
+	result, output := runPlaybook(t, `
+name: flush
+hosts: [h1]
+connection: local
+gather_facts: false
+tasks:
+  - name: change
+    command: "true"
+    notify: restart
+  - meta: flush_handlers
+  - name: between
+    command: "true"
+  - name: change again
+    command: "true"
+    notify: restart
+handlers:
+  - name: restart
+    command: "true"
+`, RunOptions{})
+
+	if result.Host("h1").Failed() {
+		t.Fatalf("play failed:\n%s", output)
+	}
+	want := []string{"change=changed", "restart=changed", "between=changed", "change again=changed", "restart=changed"}
+	if got := outcomes(result, "h1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("tasks = %v, want %v", got, want)
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	result, output := runPlaybook(t, `
+name: once
+hosts: [h1, h2, h3]
+connection: local
+gather_facts: false
+tasks:
+  - name: once
+    command: echo {{ inventory_hostname }}
+    run_once: true
+    register: first
+  - name: after
+    command: echo {{ first.stdout }}
+`, RunOptions{})
+
+	ran := ""
+	for _, host := range []string{"h1", "h2", "h3"} {
+		h := result.Host(host)
+		if h.Failed() || len(h.Tasks) != 2 {
+			t.Fatalf("%s failed or stopped early:\n%s", host, output)
+		}
+		once := h.Tasks[0]
+		switch once.Status {
+		case StatusChanged:
+			if ran != "" {
+				t.Errorf("run_once task ran on %s and %s", ran, host)
+			}
+			ran = host
+		case StatusSkipped:
+			if !strings.HasPrefix(once.Message, "run once on ") {
+				t.Errorf("%s: message = %q, want the host it ran on", host, once.Message)
+			}
+		default:
+			t.Errorf("%s: run_once task %s", host, once.Status)
+		}
+	}
+	if ran == "" {
+		t.Fatal("run_once task ran on no host")
+	}
+	for _, host := range []string{"h1", "h2", "h3"} {
+		h := result.Host(host)
+		if skipped := h.Tasks[0]; host != ran && skipped.Message != "run once on "+ran {
+			t.Errorf("%s: message = %q, want run once on %s", host, skipped.Message, ran)
+		}
+		if after := h.Tasks[1]; strings.TrimSpace(after.Stdout) != ran {
+			t.Errorf("%s: registered stdout = %q, want %q", host, after.Stdout, ran)
+		}
+	}
+}
+
+func TestStartAtTaskFilteredByTags(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "playbook.yaml")
+	err := ioutil.WriteFile(filename, []byte(`
+- name: first
+  hosts: [h1]
+  connection: local
+  gather_facts: false
+  tasks:
+    - name: setup
+      command: "true"
+      tags: setup
+- name: second
+  hosts: [h1]
+  connection: local
+  gather_facts: false
+  tasks:
+    - name: deploy
+      command: "true"
+      tags: deploy
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	_, err = RunPlaybook(filename, RunOptions{Output: &output, StartAtTask: "setup", Tags: []string{"deploy"}})
+	if err == nil || !strings.Contains(err.Error(), "no task named 'setup'") {
+		t.Fatalf("err = %v, want no task named 'setup'", err)
+	}
+	if output.Len() > 0 {
+		t.Errorf("tasks ran before the error:\n%s", output.String())
+	}
+
+	result, err := RunPlaybook(filename, RunOptions{Output: &output, StartAtTask: "deploy", Tags: []string{"deploy"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"deploy=changed"}
+	if got := outcomes(result, "h1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("tasks = %v, want %v", got, want)
+	}
+}
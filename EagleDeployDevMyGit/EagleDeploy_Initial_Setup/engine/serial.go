@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Serial is the play-level serial option. Each entry is a host count such as
+// "2" or a percentage of the play's hosts such as "30%". The entries size the
+// batches in turn and the last one repeats until every host has a batch, so
+// [1, 10%, 50%] runs one canary host, then 10% of hosts, then 50% at a time.
+type Serial []string
+
+// UnmarshalYAML accepts a single value as well as a list of values.
+func (s *Serial) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []interface{}
+	if err := unmarshal(&list); err == nil {
+		*s = nil
+		for _, value := range list {
+			*s = append(*s, fmt.Sprint(value))
+		}
+		return nil
+	}
+
+	var value interface{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*s = Serial{fmt.Sprint(value)}
+	return nil
+}
+
+// Batches splits hosts into the consecutive batches a rolling deployment
+// works through. Without a serial option all hosts form a single batch.
+func (s Serial) Batches(hosts []string) ([][]string, error) {
+	if len(s) == 0 {
+		return [][]string{hosts}, nil
+	}
+
+	var batches [][]string
+	for i, rest := 0, hosts; len(rest) > 0; i++ {
+		entry := s[len(s)-1]
+		if i < len(s) {
+			entry = s[i]
+		}
+		size, err := batchSize(entry, len(hosts))
+		if err != nil {
+			return nil, err
+		}
+		if size > len(rest) {
+			size = len(rest)
+		}
+		batches = append(batches, rest[:size])
+		rest = rest[size:]
+	}
+	return batches, nil
+}
+
+// batchSize converts one serial entry into a host count. Percentages round
+// down but never below one host.
+func batchSize(entry string, total int) (int, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.HasSuffix(entry, "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(entry, "%"))
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, fmt.Errorf("invalid serial percentage '%s'", entry)
+		}
+		size := total * percent / 100
+		if size < 1 {
+			size = 1
+		}
+		return size, nil
+	}
+
+	size, err := strconv.Atoi(entry)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid serial value '%s'", entry)
+	}
+	return size, nil
+}
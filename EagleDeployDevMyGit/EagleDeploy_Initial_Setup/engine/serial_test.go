@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func hostNames(n int) []string {
+	hosts := make([]string, n)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("h%d", i+1)
+	}
+	return hosts
+}
+
+func batchSizes(batches [][]string) []int {
+	sizes := make([]int, len(batches))
+	for i, batch := range batches {
+		sizes[i] = len(batch)
+	}
+	return sizes
+}
+
+func TestSerialBatches(t *testing.T) {
+	tests := []struct {
+		serial Serial
+		hosts  int
+		want   []int
+	}{
+		{nil, 5, []int{5}},
+		{Serial{"2"}, 5, []int{2, 2, 1}},
+		{Serial{"10"}, 3, []int{3}},
+		{Serial{"50%"}, 5, []int{2, 2, 1}},
+		{Serial{"100%"}, 7, []int{7}},
+		// A percentage never rounds down to an empty batch.
+		{Serial{"10%"}, 5, []int{1, 1, 1, 1, 1}},
+		// One canary, then 10% of the hosts, then half of them at a time.
+		{Serial{"1", "10%", "50%"}, 20, []int{1, 2, 10, 7}},
+		{Serial{"1", "10%", "50%"}, 100, []int{1, 10, 50, 39}},
+		{Serial{"1", "10%", "50%"}, 3, []int{1, 1, 1}},
+		{Serial{"1", "10%", "50%"}, 1, []int{1}},
+		// Entries past the last host are never used.
+		{Serial{"3", "1"}, 2, []int{2}},
+	}
+	for _, test := range tests {
+		hosts := hostNames(test.hosts)
+		batches, err := test.serial.Batches(hosts)
+		if err != nil {
+			t.Errorf("%v.Batches(%d hosts): %v", test.serial, test.hosts, err)
+			continue
+		}
+		if got := batchSizes(batches); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v.Batches(%d hosts) sizes = %v, want %v", test.serial, test.hosts, got, test.want)
+		}
+		var all []string
+		for _, batch := range batches {
+			all = append(all, batch...)
+		}
+		if !reflect.DeepEqual(all, hosts) {
+			t.Errorf("%v.Batches(%d hosts) = %v, want every host once in order", test.serial, test.hosts, batches)
+		}
+	}
+}
+
+func TestSerialBatchesErrors(t *testing.T) {
+	tests := []struct {
+		serial Serial
+		want   string
+	}{
+		{Serial{"0"}, "invalid serial value '0'"},
+		{Serial{"-1"}, "invalid serial value '-1'"},
+		{Serial{"many"}, "invalid serial value 'many'"},
+		{Serial{"0%"}, "invalid serial percentage '0%'"},
+		{Serial{"150%"}, "invalid serial percentage '150%'"},
+		{Serial{"x%"}, "invalid serial percentage 'x%'"},
+		{Serial{"1", "bad"}, "invalid serial value 'bad'"},
+	}
+	for _, test := range tests {
+		_, err := test.serial.Batches(hostNames(10))
+		if err == nil {
+			t.Errorf("%v.Batches succeeded, want an error", test.serial)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v.Batches error = %q, want it to contain %q", test.serial, err, test.want)
+		}
+	}
+}
+
+func TestSerialUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		src  string
+		want Serial
+	}{
+		{"serial: 2", Serial{"2"}},
+		{"serial: 30%", Serial{"30%"}},
+		{"serial: [1, 10%, 50%]", Serial{"1", "10%", "50%"}},
+		{"other: 1", nil},
+	}
+	for _, test := range tests {
+		var play struct {
+			Serial Serial `yaml:"serial"`
+		}
+		if err := yaml.Unmarshal([]byte(test.src), &play); err != nil {
+			t.Errorf("Unmarshal(%q): %v", test.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(play.Serial, test.want) {
+			t.Errorf("Unmarshal(%q) = %#v, want %#v", test.src, play.Serial, test.want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHHost is the address the test SSH server listens on. It is not
+// 127.0.0.1, which the engine always runs locally.
+const testSSHHost = "127.0.0.2"
+
+// testSSHServer is an SSH server that runs commands with bash on this
+// machine. It accepts any user with the password "secret" or clientKey, and
+// counts the connections made to it.
+type testSSHServer struct {
+	port        int
+	key         ssh.Signer
+	clientKey   ed25519.PrivateKey
+	connections int32
+}
+
+func startSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(testSSHHost, "0"))
+	if err != nil {
+		t.Skipf("unable to listen on %s: %v", testSSHHost, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPublic, err := ssh.NewPublicKey(clientKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &testSSHServer{port: listener.Addr().(*net.TCPAddr).Port, key: key, clientKey: clientKey}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientPublic.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(key)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, config)
+		}
+	}()
+	return server
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	atomic.AddInt32(&s.connections, 1)
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go runSession(channel, requests)
+	}
+}
+
+// runSession runs the command of the first exec request on a session.
+func runSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+		var exec struct{ Command string }
+		if err := ssh.Unmarshal(request.Payload, &exec); err != nil {
+			request.Reply(false, nil)
+			return
+		}
+		request.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+
+		code := runBash(exec.Command, channel)
+		status := struct{ Status uint32 }{uint32(code)}
+		channel.SendRequest("exit-status", false, ssh.Marshal(&status))
+		return
+	}
+}
+
+func runBash(command string, channel ssh.Channel) int {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Stdin = channel
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		return 255
+	}
+	return 0
+}
+
+func (s *testSSHServer) connectionCount() int {
+	return int(atomic.LoadInt32(&s.connections))
+}
+
+// writeKnownHosts writes a known_hosts file to dir that lists key for the
+// server and returns its path.
+func (s *testSSHServer) writeKnownHosts(t *testing.T, dir string, key ssh.PublicKey) string {
+	t.Helper()
+	address := knownhosts.Normalize(net.JoinHostPort(testSSHHost, strconv.Itoa(s.port)))
+	filename := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(filename, []byte(knownhosts.Line([]string{address}, key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// writeClientKey writes the private key the server accepts to dir/name.
+func (s *testSSHServer) writeClientKey(t *testing.T, dir, name string) {
+	t.Helper()
+	block, err := ssh.MarshalPrivateKey(s.clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,143 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A task's command output is passed on line by line while the command runs,
+// so a long upgrade shows progress instead of staying silent until it ends.
+// The lines are printed with a [host] task: prefix, stderr to its own writer,
+// and handed to RunOptions.OnOutput for logs and the web UI. The task result
+// still holds the whole output once the command has finished.
+
+// Output streams. StreamNotice carries the engine's own messages about a
+// task, such as retries.
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	StreamNotice = "notice"
+)
+
+// OutputLine is one line a task's command printed.
+type OutputLine struct {
+	Time   time.Time `json:"time"`
+	Host   string    `json:"host"`
+	Task   string    `json:"task"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+// WithStreaming returns a communicator that shares c's connection but calls
+// onLine with every line its commands print, or streams nothing if onLine
+// is nil.
+func (c *Communicator) WithStreaming(onLine func(stream, line string)) *Communicator {
+	copied := *c
+	copied.onLine = onLine
+	return &copied
+}
+
+// sinks returns the writers a command's stdout and stderr go to: the given
+// buffers, plus the line handler if one is set. flush passes on a last line
+// that did not end in a newline.
+func (c *Communicator) sinks(stdout, stderr *bytes.Buffer) (io.Writer, io.Writer, func()) {
+	if c.onLine == nil {
+		return stdout, stderr, func() {}
+	}
+	out := &lineWriter{emit: func(line string) { c.onLine(StreamStdout, line) }}
+	errs := &lineWriter{emit: func(line string) { c.onLine(StreamStderr, line) }}
+	flush := func() {
+		out.flush()
+		errs.flush()
+	}
+	return io.MultiWriter(stdout, out), io.MultiWriter(stderr, errs), flush
+}
+
+// lineWriter calls emit with every complete line written to it.
+type lineWriter struct {
+	emit    func(line string)
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(strings.TrimSuffix(string(w.partial[:i]), "\r"))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) flush() {
+	if len(w.partial) > 0 {
+		w.emit(string(w.partial))
+		w.partial = nil
+	}
+}
+
+// crlfWriter turns the \r\n line ends of a terminal back into \n.
+type crlfWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	if c.cr && (len(p) == 0 || p[0] != '\n') {
+		out = append(out, '\r')
+	}
+	c.cr = false
+	for i, b := range p {
+		switch {
+		case b != '\r':
+			out = append(out, b)
+		case i == len(p)-1:
+			c.cr = true
+		case p[i+1] != '\n':
+			out = append(out, b)
+		}
+	}
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// streamer returns the line handler for the command of task on host.
+func (s *Scheduler) streamer(host, task string) func(stream, line string) {
+	return func(stream, line string) {
+		output := s.output
+		if stream == StreamStderr {
+			output = s.errors
+		}
+		s.emit(output, fmt.Sprintf("[%s] %s: %s", host, task, line),
+			OutputLine{Time: time.Now(), Host: host, Task: task, Stream: stream, Text: line})
+	}
+}
+
+// notice returns the function that reports the engine's messages about task
+// on host.
+func (s *Scheduler) notice(host, task string) func(message string) {
+	return func(message string) {
+		s.emit(s.output, fmt.Sprintf("[%s] %s", host, message),
+			OutputLine{Time: time.Now(), Host: host, Task: task, Stream: StreamNotice, Text: message})
+	}
+}
+
+// emit prints text to output and hands line to RunOptions.OnOutput. Workers
+// call it concurrently, so it holds s.mu.
+func (s *Scheduler) emit(output io.Writer, text string, line OutputLine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintln(output, text)
+	if s.onOutput != nil {
+		s.onOutput(line)
+	}
+}
@@ -0,0 +1,86 @@
+package engine
+
+import "sort"
+
+// Special tags. A task tagged always runs whatever --tags selects, and one
+// tagged never only runs when one of its tags is asked for explicitly.
+const (
+	TagAlways = "always"
+	TagNever  = "never"
+)
+
+// selected decides whether a task with tags runs given the --tags and
+// --skip-tags selections. Besides plain tag names both accept "all",
+// "tagged" and "untagged".
+func selected(tags, only, skip []string) bool {
+	never := contains(tags, TagNever)
+	run := len(only) == 0 && !never
+	for _, tag := range only {
+		switch {
+		case contains(tags, TagAlways),
+			tag == "all" && !never,
+			tag == "tagged" && len(tags) > 0 && !never,
+			tag == "untagged" && len(tags) == 0,
+			contains(tags, tag):
+			run = true
+		}
+	}
+	if !run {
+		return false
+	}
+
+	for _, tag := range skip {
+		switch {
+		case tag == "all" && (!contains(tags, TagAlways) || contains(skip, TagAlways)),
+			tag == "tagged" && len(tags) > 0,
+			tag == "untagged" && len(tags) == 0,
+			contains(tags, tag):
+			return false
+		}
+	}
+	return true
+}
+
+// selectTasks returns the tasks that the tag selections let run, in order.
+// A block is kept with the tasks inside it that may run, if there are any.
+func selectTasks(tasks []Task, only, skip []string) []Task {
+	var result []Task
+	for _, task := range tasks {
+		if task.isBlock() {
+			for _, section := range task.sections() {
+				*section = selectTasks(*section, only, skip)
+			}
+			if len(task.Block) > 0 || len(task.Always) > 0 {
+				result = append(result, task)
+			}
+			continue
+		}
+		if selected(task.Tags, only, skip) {
+			result = append(result, task)
+		}
+	}
+	return result
+}
+
+// Tags returns every tag used by the playbook's tasks, sorted.
+func (p *Playbook) Tags() []string {
+	seen := make(map[string]bool)
+	var tags []string
+	var collect func(tasks []Task)
+	collect = func(tasks []Task) {
+		for _, task := range tasks {
+			for _, tag := range task.Tags {
+				if !seen[tag] {
+					seen[tag] = true
+					tags = append(tags, tag)
+				}
+			}
+			for _, section := range task.sections() {
+				collect(*section)
+			}
+		}
+	}
+	collect(p.Tasks)
+	sort.Strings(tags)
+	return tags
+}
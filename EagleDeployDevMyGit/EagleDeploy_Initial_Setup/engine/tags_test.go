@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSelected(t *testing.T) {
+	tests := []struct {
+		tags, only, skip string
+		want             bool
+	}{
+		// No selection runs everything but never.
+		{"", "", "", true},
+		{"web", "", "", true},
+		{"never", "", "", false},
+		{"never,web", "", "", false},
+
+		// Plain tags.
+		{"web", "web", "", true},
+		{"db", "web", "", false},
+		{"", "web", "", false},
+		{"web,db", "db", "", true},
+		{"web", "", "web", false},
+		{"web,db", "", "db", false},
+		{"web", "web", "web", false},
+
+		// always runs whatever is selected unless skipped itself.
+		{"always", "web", "", true},
+		{"always", "untagged", "", true},
+		{"always", "", "always", false},
+		{"always", "", "all", true},
+		{"always", "", "all,always", false},
+
+		// never only runs when one of its tags is asked for.
+		{"never,debug", "debug", "", true},
+		{"never,debug", "all", "", false},
+		{"never,debug", "tagged", "", false},
+		{"never", "never", "", true},
+
+		// all.
+		{"", "all", "", true},
+		{"web", "all", "", true},
+		{"", "", "all", false},
+		{"web", "", "all", false},
+
+		// tagged and untagged.
+		{"web", "tagged", "", true},
+		{"", "tagged", "", false},
+		{"", "untagged", "", true},
+		{"web", "untagged", "", false},
+		{"web", "", "tagged", false},
+		{"", "", "tagged", true},
+		{"", "", "untagged", false},
+		{"web", "", "untagged", true},
+	}
+	for _, test := range tests {
+		got := selected(splitTags(test.tags), splitTags(test.only), splitTags(test.skip))
+		if got != test.want {
+			t.Errorf("selected(tags %q, only %q, skip %q) = %v, want %v", test.tags, test.only, test.skip, got, test.want)
+		}
+	}
+}
+
+func TestSelectTasksBlockTags(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "playbook.yaml")
+	err := ioutil.WriteFile(filename, []byte(`
+name: tags
+hosts: [h1]
+tasks:
+  - name: plain
+    command: "true"
+  - block:
+      - name: install
+        command: "true"
+      - name: migrate
+        command: "true"
+        tags: db
+    rescue:
+      - name: recover
+        command: "true"
+    always:
+      - name: cleanup
+        command: "true"
+        tags: always
+    tags: web
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plays, err := LoadPlays(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		only, skip string
+		want       []string
+	}{
+		{"", "", []string{"plain", "install", "migrate", "recover", "cleanup"}},
+		{"web", "", []string{"install", "migrate", "recover", "cleanup"}},
+		{"db", "", []string{"migrate", "cleanup"}},
+		{"untagged", "", []string{"plain", "cleanup"}},
+		{"tagged", "", []string{"install", "migrate", "recover", "cleanup"}},
+		{"", "web", []string{"plain"}},
+		{"", "db", []string{"plain", "install", "recover", "cleanup"}},
+		{"nosuchtag", "", []string{"cleanup"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, task := range selectTasks(plays[0].Tasks, splitTags(test.only), splitTags(test.skip)) {
+			if !task.isBlock() {
+				got = append(got, task.Name)
+				continue
+			}
+			for _, section := range task.sections() {
+				for _, child := range *section {
+					got = append(got, child.Name)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("only %q, skip %q: got %v, want %v", test.only, test.skip, got, test.want)
+		}
+	}
+}
+
+func splitTags(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Templates are plain text with {{ expression }} placeholders, as used in
+// commands and loop: values. Each placeholder is evaluated with the same
+// rules as when: conditions and replaced by its value.
+
+// templatePart is either literal text or a parsed placeholder.
+type templatePart struct {
+	text string
+	expr *Expr
+}
+
+func parseTemplate(text string) ([]templatePart, error) {
+	var parts []templatePart
+	for {
+		start := strings.Index(text, "{{")
+		if start < 0 {
+			if text != "" {
+				parts = append(parts, templatePart{text: text})
+			}
+			return parts, nil
+		}
+		end := strings.Index(text[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed '{{' in %q", text)
+		}
+		expr, err := ParseExpr(strings.TrimSpace(text[start+2 : start+end]))
+		if err != nil {
+			return nil, err
+		}
+		if start > 0 {
+			parts = append(parts, templatePart{text: text[:start]})
+		}
+		parts = append(parts, templatePart{expr: expr})
+		text = text[start+end+2:]
+	}
+}
+
+// Render replaces every {{ }} placeholder in text with its value in vars.
+func Render(text string, vars map[string]interface{}) (string, error) {
+	parts, err := parseTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, part := range parts {
+		if part.expr == nil {
+			sb.WriteString(part.text)
+			continue
+		}
+		value, err := part.expr.Eval(vars)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(toString(value))
+	}
+	return sb.String(), nil
+}
+
+// renderValue is Render for values that need not end up as text: a string
+// that is a single placeholder keeps the type of its value, so a list stays
+// a list. Strings inside lists and maps are rendered too.
+func renderValue(value interface{}, vars map[string]interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		parts, err := parseTemplate(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 1 && parts[0].expr != nil {
+			return parts[0].expr.Eval(vars)
+		}
+		return Render(v, vars)
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			rendered, err := renderValue(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = rendered
+		}
+		return list, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			rendered, err := renderValue(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = rendered
+		}
+		return m, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Vars holds variables as expressions see them: maps are keyed by string and
+// nested values use only []interface{} and map[string]interface{}.
+type Vars map[string]interface{}
+
+func (v *Vars) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*v = make(Vars, len(raw))
+	for key, value := range raw {
+		(*v)[key] = normalize(value)
+	}
+	return nil
+}
+
+// normalize converts the maps yaml.v2 produces into map[string]interface{}.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalize(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = normalize(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = normalize(item)
+		}
+		return list
+	}
+	return value
+}
+
+// factsCommand prints what gatherFacts needs as KEY=value lines.
+const factsCommand = `echo "SYSTEM=$(uname -s)"; echo "ARCH=$(uname -m)"; echo "KERNEL=$(uname -r)"; ` +
+	`echo "HOSTNAME=$(hostname)"; cat /etc/os-release 2>/dev/null; true`
+
+// gatherFacts collects the ansible_* facts of a connected host.
+func gatherFacts(communicator *Communicator) (Vars, error) {
+	output, err := communicator.RunCommand(context.Background(), factsCommand)
+	if err != nil {
+		return nil, fmt.Errorf("unable to gather facts: %v", err)
+	}
+
+	values := make(map[string]string)
+	for _, line := range strings.Split(output.Stdout, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok {
+			values[key] = strings.Trim(value, `"'`)
+		}
+	}
+
+	distribution := distributionNames[values["ID"]]
+	if distribution == "" {
+		distribution = values["NAME"]
+	}
+	if distribution == "" {
+		distribution = values["SYSTEM"]
+	}
+	family := osFamilies[values["ID"]]
+	for _, like := range strings.Fields(values["ID_LIKE"]) {
+		if family == "" {
+			family = osFamilies[like]
+		}
+	}
+	if family == "" {
+		family = distribution
+	}
+
+	hostname, _, _ := strings.Cut(values["HOSTNAME"], ".")
+	version := values["VERSION_ID"]
+	major, _, _ := strings.Cut(version, ".")
+	return Vars{
+		"ansible_system":                     values["SYSTEM"],
+		"ansible_architecture":               values["ARCH"],
+		"ansible_kernel":                     values["KERNEL"],
+		"ansible_hostname":                   hostname,
+		"ansible_fqdn":                       values["HOSTNAME"],
+		"ansible_distribution":               distribution,
+		"ansible_distribution_version":       version,
+		"ansible_distribution_major_version": major,
+		"ansible_os_family":                  family,
+	}, nil
+}
+
+var distributionNames = map[string]string{
+	"ubuntu":    "Ubuntu",
+	"debian":    "Debian",
+	"centos":    "CentOS",
+	"rhel":      "RedHat",
+	"fedora":    "Fedora",
+	"rocky":     "Rocky",
+	"almalinux": "AlmaLinux",
+	"amzn":      "Amazon",
+	"opensuse":  "openSUSE",
+	"sles":      "SLES",
+	"arch":      "Archlinux",
+	"alpine":    "Alpine",
+}
+
+var osFamilies = map[string]string{
+	"debian":    "Debian",
+	"ubuntu":    "Debian",
+	"rhel":      "RedHat",
+	"centos":    "RedHat",
+	"fedora":    "RedHat",
+	"rocky":     "RedHat",
+	"almalinux": "RedHat",
+	"amzn":      "RedHat",
+	"suse":      "Suse",
+	"opensuse":  "Suse",
+	"sles":      "Suse",
+	"arch":      "Archlinux",
+	"alpine":    "Alpine",
+}
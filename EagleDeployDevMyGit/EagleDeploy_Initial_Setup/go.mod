@@ -3,7 +3,8 @@ module EagleDeploy
 go 1.23.2
 
 require (
-	golang.org/x/crypto v0.28.0 // indirect
-	golang.org/x/sys v0.26.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	golang.org/x/crypto v0.28.0
+	gopkg.in/yaml.v2 v2.4.0
 )
+
+require golang.org/x/sys v0.26.0 // indirect
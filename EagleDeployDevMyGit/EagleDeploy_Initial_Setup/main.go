@@ -1,23 +1,31 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"log"
 	"os"
+
+	"EagleDeploy/engine"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: eagle <playbook.yaml>")
+	forks := flag.Int("forks", 0, "Maximum number of hosts to work on at once (default: settings.forks or 5)")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Println("Usage: eagle [--forks N] <playbook.yaml>")
 		os.Exit(1)
 	}
 
-	playbookFile := os.Args[1]
-	tasks, err := ParsePlaybook(playbookFile)
+	playbookFile := flag.Arg(0)
+	result, err := engine.RunPlaybook(playbookFile, engine.RunOptions{Forks: *forks, Output: os.Stdout})
 	if err != nil {
-		log.Fatalf("Failed to parse playbook: %v", err)
+		fmt.Printf("Failed to run playbook: %v\n", err)
+		os.Exit(1)
 	}
 
-	scheduler := NewScheduler(tasks)
-	scheduler.RunTasks()
+	result.Print(os.Stdout)
+	if result.Failed() {
+		os.Exit(2)
+	}
 }
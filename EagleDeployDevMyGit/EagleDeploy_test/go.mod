@@ -2,4 +2,15 @@ module eagledeploy3
 
 go 1.23.2
 
-require gopkg.in/yaml.v2 v2.4.0
+require (
+	EagleDeploy v0.0.0
+	golang.org/x/term v0.25.0
+)
+
+require (
+	golang.org/x/crypto v0.28.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
+
+replace EagleDeploy => ../EagleDeploy_Initial_Setup
@@ -1,89 +1,89 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
-)
 
-// Structs for the YAML structure
-type Task struct {
-	Name    string `yaml:"name"`
-	Command string `yaml:"command"`
-}
-type Playbook struct {
-	Name     string   `yaml:"name"`
-	Version  string   `yaml:"version"`
-	Tasks    []Task   `yaml:"tasks"`
-	Hosts    []string `yaml:"hosts"`
-	Settings map[string]int `yaml:"settings"`
-}
+	"EagleDeploy/engine"
+
+	"golang.org/x/term"
+)
 
-// Function to execute the YAML file by parsing its content
-func executeYAML(ymlFilePath string, targetHosts []string) {
-	data, err := ioutil.ReadFile(ymlFilePath)
+// Function to execute the YAML file and print the result of every task
+func executeYAML(ymlFilePath string, options engine.RunOptions) *engine.RunResult {
+	options.Output = os.Stdout
+	options.ErrorOutput = os.Stderr
+	result, err := engine.RunPlaybook(ymlFilePath, options)
 	if err != nil {
-		log.Fatalf("Error reading YAML file: %v", err)
+		fmt.Printf("Error: %v\n", err)
+		return nil
 	}
+	result.Print(os.Stdout)
+	return result
+}
 
-	var playbook Playbook
-	err = yaml.Unmarshal(data, &playbook)
+// Function to ask for the become password without echoing it
+func askBecomePass() (string, error) {
+	fmt.Print("BECOME password: ")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
 	if err != nil {
-		log.Fatalf("Error parsing YAML file: %v", err)
+		return "", fmt.Errorf("unable to read become password: %v", err)
 	}
+	return string(password), nil
+}
 
-	// Validate required fields
-	if len(playbook.Tasks) == 0 {
-		log.Fatalf("Error: No tasks found in the playbook.")
+// Function to list the tags of every task in a YAML file
+func listTags(ymlFilePath string) error {
+	plays, err := engine.LoadPlays(ymlFilePath)
+	if err != nil {
+		return err
 	}
-
-	// Determine target hosts
-	var hosts []string
-	if len(targetHosts) > 0 {
-		for _, host := range playbook.Hosts {
-			if contains(targetHosts, host) {
-				hosts = append(hosts, host)
-			}
-		}
-		if len(hosts) == 0 {
-			log.Fatalf("Error: No matching hosts found in the playbook for the provided targets.")
+	for _, play := range plays {
+		fmt.Printf("Play: %s\n", play.Name)
+		for _, task := range play.Tasks {
+			fmt.Printf("  %s: %v\n", task.Name, []string(task.Tags))
 		}
-	} else {
-		hosts = playbook.Hosts
+		fmt.Printf("All tags: %v\n", play.Tags())
 	}
+	return nil
+}
 
-	fmt.Printf("Executing Playbook: %s (Version: %s) on Hosts: %v\n", playbook.Name, playbook.Version, hosts)
-	for _, task := range playbook.Tasks {
-		if task.Command == "" {
-			log.Fatalf("Error: Task '%s' has no command to execute.", task.Name)
-		}
-
-		fmt.Printf("Executing Task: %s\n", task.Name)
-		// Execute the command (here just local example, can add SSH for remote)
-		cmd := exec.Command("bash", "-c", task.Command)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			fmt.Printf("Error executing task '%s': %v\n", task.Name, err)
-		} else {
-			fmt.Printf("Output of '%s':\n%s\n", task.Name, string(output))
+// Function to ask before each task in step mode
+func stepPrompt(reader *bufio.Reader) func(task string) engine.StepAnswer {
+	return func(task string) engine.StepAnswer {
+		for {
+			fmt.Printf("Perform task: %s (y)es/(n)o/(c)ontinue: ", task)
+			answer, err := reader.ReadString('\n')
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "y", "yes":
+				return engine.StepYes
+			case "c", "continue":
+				return engine.StepContinue
+			case "n", "no":
+				return engine.StepNo
+			}
+			if err != nil {
+				return engine.StepNo
+			}
 		}
 	}
 }
 
-// Helper function to check if a slice contains a specific element
-func contains(slice []string, item string) bool {
-	for _, v := range slice {
-		if v == item {
-			return true
+// Function to split a comma-separated flag value into trimmed items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
 	}
-	return false
+	return items
 }
 
 // Function to list YAML files based on a keyword in the current directory
@@ -92,6 +92,12 @@ func listYAMLFiles(keyword string) {
 		if err != nil {
 			return err
 		}
+		if info.IsDir() && filepath.Base(filepath.Dir(path)) == "roles" {
+			if strings.Contains(info.Name(), keyword) {
+				fmt.Println("Found role:", path)
+			}
+			return nil
+		}
 		if filepath.Ext(path) == ".yaml" || filepath.Ext(path) == ".yml" {
 			if strings.Contains(path, keyword) {
 				fmt.Println("Found YAML file:", path)
@@ -107,7 +113,23 @@ func listYAMLFiles(keyword string) {
 func main() {
 	// Parse command-line arguments
 	var hostsFlag string
+	var forksFlag int
+	var checkFlag, diffFlag bool
+	var tagsFlag, skipTagsFlag string
+	var listTagsFlag bool
+	var startAtTaskFlag string
+	var stepFlag bool
+	var askBecomePassFlag bool
 	flag.StringVar(&hostsFlag, "hosts", "", "Comma-separated list of hosts to target")
+	flag.IntVar(&forksFlag, "forks", 0, "Maximum number of hosts to work on at once")
+	flag.BoolVar(&checkFlag, "check", false, "Dry run: report what would change without changing anything")
+	flag.BoolVar(&diffFlag, "diff", false, "Show a diff of every file a task changes")
+	flag.StringVar(&tagsFlag, "tags", "", "Comma-separated list of tags; only tasks with one of them run")
+	flag.StringVar(&skipTagsFlag, "skip-tags", "", "Comma-separated list of tags; tasks with one of them are skipped")
+	flag.BoolVar(&listTagsFlag, "list-tags", false, "List the tags of the playbook instead of running it")
+	flag.StringVar(&startAtTaskFlag, "start-at-task", "", "Start the playbook at the task with this name")
+	flag.BoolVar(&stepFlag, "step", false, "Confirm each task before it runs")
+	flag.BoolVar(&askBecomePassFlag, "ask-become-pass", false, "Ask for the password used by become")
 	flag.Parse()
 
 	// Split the hostsFlag into a slice if provided
@@ -135,8 +157,41 @@ func main() {
 			os.Exit(1)
 		}
 		ymlFilePath := flag.Args()[1]
+		if listTagsFlag {
+			if err := listTags(ymlFilePath); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
 		fmt.Printf("Executing YAML file: %s\n", ymlFilePath)
-		executeYAML(ymlFilePath, targetHosts)
+		options := engine.RunOptions{
+			Hosts:       targetHosts,
+			Forks:       forksFlag,
+			Check:       checkFlag,
+			Diff:        diffFlag,
+			Tags:        splitList(tagsFlag),
+			SkipTags:    splitList(skipTagsFlag),
+			StartAtTask: startAtTaskFlag,
+		}
+		if askBecomePassFlag {
+			password, err := askBecomePass()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			options.BecomePassword = password
+		}
+		if stepFlag {
+			options.Step = stepPrompt(bufio.NewReader(os.Stdin))
+		}
+		result := executeYAML(ymlFilePath, options)
+		if result == nil {
+			os.Exit(1)
+		}
+		if result.Failed() {
+			os.Exit(2)
+		}
 
 	case "-l": // List YAML files or related names
 		if len(flag.Args()) < 2 {
@@ -151,8 +206,17 @@ func main() {
 		fmt.Println("Help Page:")
 		fmt.Println("Commands:")
 		fmt.Println("-e <yaml-file>: Execute the specified YAML file.")
-		fmt.Println("-l <keyword>: List YAML files or related names in the EagleDeployment directory.")
+		fmt.Println("-l <keyword>: List YAML files and roles matching the keyword in the EagleDeployment directory.")
 		fmt.Println("-hosts <comma-separated-hosts>: Specify hosts to target (only with -e).")
+		fmt.Println("-forks <n>: Maximum number of hosts to work on at once (only with -e).")
+		fmt.Println("-check: Dry run that reports what would change without changing anything (only with -e).")
+		fmt.Println("-diff: Show a diff of every file a task changes, or would change with -check (only with -e).")
+		fmt.Println("-tags <comma-separated-tags>: Only run tasks with one of these tags (only with -e).")
+		fmt.Println("-skip-tags <comma-separated-tags>: Skip tasks with one of these tags (only with -e).")
+		fmt.Println("-list-tags: List the tags used in the playbook instead of running it (only with -e).")
+		fmt.Println("-start-at-task <name>: Skip the tasks before the named one (only with -e).")
+		fmt.Println("-step: Ask (y)es, (n)o or (c)ontinue before each task (only with -e).")
+		fmt.Println("-ask-become-pass: Ask for the sudo or su password of become tasks (only with -e).")
 		fmt.Println("-h: Display this help page.")
 
 	default: